@@ -0,0 +1,248 @@
+package redkeep
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//WatchKindAggregate keeps an aggregate of all referencing documents in the referenced document
+const WatchKindAggregate = "aggregate"
+
+//all supported aggregate functions
+const (
+	//AggregateCount counts the referencing documents
+	AggregateCount = "count"
+	//AggregateSum sums up Field of the referencing documents
+	AggregateSum = "sum"
+	//AggregateMin is the lowest Field of the referencing documents
+	AggregateMin = "min"
+	//AggregateMax is the highest Field of the referencing documents
+	AggregateMax = "max"
+	//AggregateLastModified is the highest Field of the referencing documents, or
+	//without Field the time of the last change of one of them
+	AggregateLastModified = "lastModified"
+)
+
+//defaultReferenceIndex is the collection in the database of the
+//target collection that stores the references of all aggregated documents
+const defaultReferenceIndex = "redkeepReferences"
+
+//isAggregate returns true if w keeps an aggregate of its tracked documents
+func isAggregate(w Watch) bool {
+	return w.Kind == WatchKindAggregate
+}
+
+//referenceIndex returns the collection that remembers which document
+//every aggregated document references, it is needed to find the
+//referenced document once the aggregated document is removed
+func referenceIndex(session *mgo.Session, w Watch) *mgo.Collection {
+	return getCollection(session, referenceIndexNamespace(w))
+}
+
+//referenceIndexNamespace returns the namespace of the reference index of w
+func referenceIndexNamespace(w Watch) string {
+	if w.Aggregate.IndexCollection != "" {
+		return w.Aggregate.IndexCollection
+	}
+
+	db := w.TargetCollection[:strings.Index(w.TargetCollection, ".")]
+	return db + "." + defaultReferenceIndex
+}
+
+//referenceIndexID identifies the entry of one aggregated document
+func referenceIndexID(w Watch, id interface{}) bson.D {
+	return bson.D{
+		{Name: "watch", Value: w.TargetCollection + "." + w.TargetNormalizedField},
+		{Name: "child", Value: id},
+	}
+}
+
+//childReference returns the value child uses to reference its parent
+//in the same form as parentReference, so it can be used with targetSelector
+func childReference(w Watch, child map[string]interface{}) (interface{}, bool) {
+	value := GetValue(w.TriggerReference, child)
+	if value == nil {
+		return nil, false
+	}
+
+	db := w.TargetCollection[:strings.Index(w.TargetCollection, ".")]
+	ref, ok := getSourceRef(parentWatch(w), value, db)
+	if !ok {
+		return nil, false
+	}
+
+	if id, isID := ref.Value.(bson.ObjectId); isID && referenceType(w) == ReferenceString {
+		return id.Hex(), true
+	}
+
+	return ref.Value, true
+}
+
+//parentSelector selects the parent that children reference with reference
+func parentSelector(w Watch, reference interface{}) bson.M {
+	switch referenceType(w) {
+	case ReferenceString:
+		hex, _ := reference.(string)
+		if !bson.IsObjectIdHex(hex) {
+			return bson.M{"_id": reference}
+		}
+
+		return bson.M{"_id": bson.ObjectIdHex(hex)}
+	case ReferenceScalar:
+		return bson.M{referenceField(w): reference}
+	}
+
+	return bson.M{"_id": reference}
+}
+
+//computeAggregate returns the aggregate of all children that reference
+//parent, lastModified without field can not be computed
+func computeAggregate(session *mgo.Session, w Watch) computeFunc {
+	return func(parent map[string]interface{}) (interface{}, bool, error) {
+		reference, ok := parentReference(w, parent)
+		if !ok {
+			return nil, false, nil
+		}
+
+		return aggregate(session, w, reference)
+	}
+}
+
+//aggregate computes the aggregate of all children that use reference
+func aggregate(session *mgo.Session, w Watch, reference interface{}) (interface{}, bool, error) {
+	children := getCollection(session, w.TrackCollection)
+	selector := targetSelector(w, reference)
+
+	operator := "$" + w.Aggregate.Function
+	switch w.Aggregate.Function {
+	case AggregateCount:
+		count, err := children.Find(selector).Count()
+		return count, err == nil, err
+	case AggregateLastModified:
+		if w.Aggregate.Field == "" {
+			return nil, false, nil
+		}
+
+		operator = "$max"
+	}
+
+	var result []struct {
+		Value interface{} `bson:"value"`
+	}
+
+	err := children.Pipe([]bson.M{
+		{"$match": selector},
+		{"$group": bson.M{"_id": nil, "value": bson.M{operator: "$" + w.Aggregate.Field}}},
+	}).All(&result)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(result) == 0 {
+		if w.Aggregate.Function == AggregateSum {
+			return 0, true, nil
+		}
+
+		return nil, true, nil
+	}
+
+	return result[0].Value, true, nil
+}
+
+//handleAggregateChange recomputes the aggregates of the previous and
+//the current parent of the child with the given id. The reference index
+//is updated last, so a failed change still knows the previous parent.
+func (c changeTracker) handleAggregateChange(w Watch, id interface{}) error {
+	session := c.session.Copy()
+	defer session.Close()
+
+	index := referenceIndex(session, w)
+	indexID := referenceIndexID(w, id)
+
+	var references []interface{}
+
+	var previous struct {
+		Parent interface{} `bson:"parent"`
+	}
+
+	err := index.FindId(indexID).One(&previous)
+	if err == nil {
+		references = append(references, previous.Parent)
+	} else if err != mgo.ErrNotFound {
+		return err
+	}
+
+	child := map[string]interface{}{}
+	err = getCollection(session, w.TrackCollection).FindId(id).One(&child)
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+
+	current, ok := childReference(w, child)
+	if ok && (len(references) == 0 || !reflect.DeepEqual(current, references[0])) {
+		references = append(references, current)
+	}
+
+	for _, reference := range references {
+		if err := c.updateAggregate(session, w, reference); err != nil {
+			return err
+		}
+	}
+
+	if ok {
+		return c.writer.Upsert(referenceIndexNamespace(w), bson.M{"_id": indexID}, bson.M{"$set": bson.M{"parent": current}})
+	}
+
+	return c.writer.RemoveAll(referenceIndexNamespace(w), bson.M{"_id": indexID})
+}
+
+//updateAggregate recomputes the aggregate of the parents that
+//children reference with reference
+func (c changeTracker) updateAggregate(session *mgo.Session, w Watch, reference interface{}) error {
+	defer c.parents.lock(w.TargetCollection, reference)()
+
+	var query bson.M
+	if w.Aggregate.Function == AggregateLastModified && w.Aggregate.Field == "" {
+		query = bson.M{"$max": bson.M{w.TargetNormalizedField: time.Now()}}
+	} else {
+		value, ok, err := aggregate(session, w, reference)
+		if err != nil || !ok {
+			return err
+		}
+
+		query = bson.M{"$set": bson.M{w.TargetNormalizedField: value}}
+	}
+
+	return c.writer.UpdateAll(w.TargetCollection, parentSelector(w, reference), query)
+}
+
+//rebuildReferenceIndex stores the reference of every child of w in the reference index
+func rebuildReferenceIndex(session *mgo.Session, w Watch, batchSize int) error {
+	index := referenceIndex(session, w)
+	children := getCollection(session, w.TrackCollection)
+	selector := bson.M{w.TriggerReference: bson.M{"$exists": true}}
+
+	return scanTargets(children, selector, nil, batchSize, func(batch []map[string]interface{}) error {
+		bulk := index.Bulk()
+		bulk.Unordered()
+
+		entries := 0
+		for _, child := range batch {
+			if reference, ok := childReference(w, child); ok {
+				bulk.Upsert(bson.M{"_id": referenceIndexID(w, child["_id"])}, bson.M{"$set": bson.M{"parent": reference}})
+				entries++
+			}
+		}
+
+		if entries == 0 {
+			return nil
+		}
+
+		_, err := bulk.Run()
+		return err
+	})
+}
@@ -0,0 +1,141 @@
+package redkeep
+
+import (
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const defaultBatchSize = 500
+
+//BackfillOptions tune a backfill
+//BatchSize is the number of target documents updated at once (default 500),
+//StartAfter resumes a backfill after the target document with that id and
+//Progress, if set, is called after every batch.
+type BackfillOptions struct {
+	BatchSize  int
+	StartAfter interface{}
+	Progress   func(BackfillProgress)
+}
+
+//BackfillProgress reports how far a backfill got, LastID
+//can be used as StartAfter to resume the backfill
+type BackfillProgress struct {
+	Processed int
+	Updated   int
+	Total     int
+	LastID    interface{}
+}
+
+//Backfill denormalizes all existing documents in the target collection
+//of w, just as if they had been inserted while redkeep was running.
+//Summaries and aggregates of all referenced documents are recomputed,
+//for aggregates the reference index is rebuilt first.
+func Backfill(session *mgo.Session, w Watch, options BackfillOptions) error {
+	session = session.Copy()
+	defer session.Close()
+
+	batchSize := options.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+
+	if isSummary(w) {
+		return backfillComputed(session, w, options, batchSize, computeSummary(session, w))
+	}
+
+	if isAggregate(w) {
+		if err := rebuildReferenceIndex(session, w, batchSize); err != nil {
+			return err
+		}
+
+		return backfillComputed(session, w, options, batchSize, computeAggregate(session, w))
+	}
+
+	targetDB := w.TargetCollection[:strings.Index(w.TargetCollection, ".")]
+	collection := getCollection(session, w.TargetCollection)
+
+	selector := bson.M{referencePath(w): bson.M{"$exists": true}}
+	total, err := countTargets(collection, selector, options.StartAfter)
+	if err != nil {
+		return err
+	}
+
+	progress := BackfillProgress{Total: total, LastID: options.StartAfter}
+	return scanTargets(collection, selector, options.StartAfter, batchSize, func(batch []map[string]interface{}) error {
+		updated, err := backfillBatch(newSourceCache(session), w, targetDB, collection, batch)
+		if err != nil {
+			return err
+		}
+
+		progress.Processed += len(batch)
+		progress.Updated += updated
+		progress.LastID = batch[len(batch)-1]["_id"]
+		if options.Progress != nil {
+			options.Progress(progress)
+		}
+
+		return nil
+	})
+}
+
+//backfillBatch writes the normalized fields into all targets of one batch
+func backfillBatch(
+	sources *sourceCache,
+	w Watch,
+	targetDB string,
+	collection *mgo.Collection,
+	batch []map[string]interface{},
+) (int, error) {
+	bulk := collection.Bulk()
+	bulk.Unordered()
+
+	updated := 0
+	for _, target := range batch {
+		query := bson.M{}
+		for _, reference := range documentReferences(w, target) {
+			ref, ok := getSourceRef(w, reference.value, targetDB)
+			if !ok {
+				continue
+			}
+
+			ref, ok, err := followVia(w, ref, sources.load)
+			if err != nil {
+				return 0, err
+			}
+
+			if !ok {
+				continue
+			}
+
+			source, err := sources.load(ref)
+			if err != nil {
+				return 0, err
+			}
+
+			if source == nil {
+				continue
+			}
+
+			fields, _ := BuildInsertQuery(normalizedWatch(w, ref.Value, reference.index), source)["$set"].(bson.M)
+			for key, value := range fields {
+				addToQuery(query, "$set", key, value)
+			}
+		}
+
+		if len(query) == 0 {
+			continue
+		}
+
+		bulk.Update(bson.M{"_id": target["_id"]}, query)
+		updated++
+	}
+
+	if updated == 0 {
+		return 0, nil
+	}
+
+	_, err := bulk.Run()
+	return updated, err
+}
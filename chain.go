@@ -0,0 +1,241 @@
+package redkeep
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//Hop is one intermediate collection of a watch that follows a chain of
+//references. TriggerReference is the DBRef inside of Collection that
+//points to the next hop or the tracked document.
+type Hop struct {
+	Collection       string `json:"collection"`
+	TriggerReference string `json:"triggerReference"`
+}
+
+//HopTracker can handle changes of the references of intermediate documents
+type HopTracker interface {
+	HandleHopChange(w Watch, hop int, id interface{}) error
+}
+
+//followVia follows the hops of w from ref, which references the first hop,
+//to the tracked document. load is used to read the intermediate documents,
+//it returns nil if a document does not exist.
+func followVia(w Watch, ref sourceRef, load func(sourceRef) (map[string]interface{}, error)) (sourceRef, bool, error) {
+	for _, hop := range w.Via {
+		document, err := load(ref)
+		if err != nil || document == nil {
+			return sourceRef{}, false, err
+		}
+
+		db := hop.Collection[:strings.Index(hop.Collection, ".")]
+		next, ok := getReference(GetValue(hop.TriggerReference, document), db)
+		if !ok {
+			return sourceRef{}, false, nil
+		}
+
+		ref = sourceRef{Namespace: next.Database + "." + next.Collection, Field: "_id", Value: next.Id}
+	}
+
+	return ref, true, nil
+}
+
+//loadFunc loads referenced documents with session
+func loadFunc(session *mgo.Session) func(sourceRef) (map[string]interface{}, error) {
+	return func(ref sourceRef) (map[string]interface{}, error) {
+		document := map[string]interface{}{}
+		err := getCollection(session, ref.Namespace).Find(ref.selector()).One(&document)
+		if err == mgo.ErrNotFound {
+			return nil, nil
+		}
+
+		return document, err
+	}
+}
+
+//referencingIDs walks the hops of w backwards starting before hop and
+//returns the ids of all documents of the first hop that reach one of ids
+func referencingIDs(session *mgo.Session, w Watch, hop int, ids []interface{}) ([]interface{}, error) {
+	for i := hop - 1; i >= 0 && len(ids) > 0; i-- {
+		var documents []struct {
+			ID interface{} `bson:"_id"`
+		}
+
+		selector := bson.M{w.Via[i].TriggerReference + ".$id": bson.M{"$in": ids}}
+		err := getCollection(session, w.Via[i].Collection).Find(selector).Select(bson.M{"_id": 1}).All(&documents)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = make([]interface{}, len(documents))
+		for j, d := range documents {
+			ids[j] = d.ID
+		}
+	}
+
+	return ids, nil
+}
+
+//viaReference returns the reference that selects all targets
+//which reach the tracked document with the given id
+func viaReference(session *mgo.Session, w Watch, id interface{}) (interface{}, bool, error) {
+	s := session.Copy()
+	defer s.Close()
+
+	ids, err := referencingIDs(s, w, len(w.Via), []interface{}{id})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return bson.M{"$in": ids}, len(ids) > 0, nil
+}
+
+//HandleHopChange denormalizes all targets that reach the
+//document with the given id of one hop of w again
+func (c changeTracker) HandleHopChange(w Watch, hop int, id interface{}) error {
+	session := c.session.Copy()
+	defer session.Close()
+
+	ids, err := referencingIDs(session, w, hop, []interface{}{id})
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+
+	p := strings.Index(w.TargetCollection, ".")
+	targetRef := mgo.DBRef{Database: w.TargetCollection[:p], Collection: w.TargetCollection[p+1:]}
+
+	var target map[string]interface{}
+	iter := getCollection(session, w.TargetCollection).Find(targetSelector(w, bson.M{"$in": ids})).Iter()
+	for iter.Next(&target) {
+		targetRef.Id = target["_id"]
+		if err := c.HandleInsert(w, target, targetRef); err != nil {
+			iter.Close()
+			return err
+		}
+
+		target = nil
+	}
+
+	return iter.Close()
+}
+
+//validateVia checks the hops of a watch, all references
+//along the chain have to be DBRefs
+func (w Watch) validateVia() error {
+	if len(w.Via) == 0 {
+		return nil
+	}
+
+	if w.Kind != "" && w.Kind != WatchKindCopy {
+		return fmt.Errorf("Via can only be used by watches of kind copy")
+	}
+
+	if referenceType(w) != ReferenceDBRef || w.ReferenceArray || strings.Contains(w.TriggerReference, "$[]") {
+		return fmt.Errorf("Via can only be used with single DBRef references")
+	}
+
+	if w.BehaviourSettings.DeletePolicy() == OnDeleteNullify {
+		return fmt.Errorf("Via can not be combined with OnDelete nullify")
+	}
+
+	for _, hop := range w.Via {
+		if strings.Count(hop.Collection, ".") < 1 {
+			return fmt.Errorf("Via collections must be in the scheme database.collection")
+		}
+
+		if !validPath(hop.TriggerReference) {
+			return fmt.Errorf("Via triggerReference must be a valid field")
+		}
+	}
+
+	return nil
+}
+
+//reactsTo returns true if a change of field inside of
+//collection might lead to writes of w
+func reactsTo(w Watch, collection, field string) bool {
+	change := map[string]interface{}{"$set": map[string]interface{}{field: nil}}
+
+	if collection == w.TrackCollection {
+		if isSummary(w) || isAggregate(w) {
+			return true
+		}
+
+		if TouchesTrackedFields(w, change) {
+			return true
+		}
+	}
+
+	if collection == w.TargetCollection && !isSummary(w) && !isAggregate(w) {
+		path := referencePath(w)
+		if field == path || strings.HasPrefix(field, path+".") || strings.HasPrefix(path, field+".") {
+			return true
+		}
+	}
+
+	for _, hop := range w.Via {
+		if collection == hop.Collection && TouchesTrackedFields(Watch{TrackFields: []string{hop.TriggerReference}}, change) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//findCycle returns the indexes of watches whose writes trigger each
+//other in a cycle, so they would update documents forever
+func findCycle(watches []Watch) []int {
+	edges := make([][]int, len(watches))
+	for i, w := range watches {
+		for j, v := range watches {
+			if reactsTo(v, w.TargetCollection, w.TargetNormalizedField) {
+				edges[i] = append(edges[i], j)
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := make([]int, len(watches))
+	var path []int
+	var visit func(i int) []int
+	visit = func(i int) []int {
+		state[i] = visiting
+		path = append(path, i)
+		for _, j := range edges[i] {
+			switch state[j] {
+			case visiting:
+				for k, p := range path {
+					if p == j {
+						return append(append([]int{}, path[k:]...), j)
+					}
+				}
+			case unvisited:
+				if cycle := visit(j); cycle != nil {
+					return cycle
+				}
+			}
+		}
+
+		path = path[:len(path)-1]
+		state[i] = visited
+		return nil
+	}
+
+	for i := range watches {
+		if state[i] == unvisited {
+			if cycle := visit(i); cycle != nil {
+				return cycle
+			}
+		}
+	}
+
+	return nil
+}
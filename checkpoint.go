@@ -0,0 +1,187 @@
+package redkeep
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const defaultCheckpointName = "redkeep"
+
+//CheckpointStore persists the timestamp of the last
+//oplog entry that has been processed completely
+type CheckpointStore interface {
+	//Load returns the stored timestamp, 0 if there is none yet
+	Load() (bson.MongoTimestamp, error)
+	Save(ts bson.MongoTimestamp) error
+}
+
+type mongoCheckpointStore struct {
+	session            *mgo.Session
+	database, name, id string
+}
+
+func (m mongoCheckpointStore) Load() (bson.MongoTimestamp, error) {
+	session := m.session.Copy()
+	defer session.Close()
+
+	var result struct {
+		Timestamp bson.MongoTimestamp `bson:"ts"`
+	}
+
+	err := session.DB(m.database).C(m.name).FindId(m.id).One(&result)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	}
+
+	return result.Timestamp, err
+}
+
+func (m mongoCheckpointStore) Save(ts bson.MongoTimestamp) error {
+	session := m.session.Copy()
+	defer session.Close()
+
+	_, err := session.DB(m.database).C(m.name).UpsertId(m.id, bson.M{"$set": bson.M{"ts": ts}})
+	return err
+}
+
+type fileCheckpointStore struct {
+	path string
+}
+
+func (f fileCheckpointStore) Load() (bson.MongoTimestamp, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	ts, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return bson.MongoTimestamp(ts), nil
+}
+
+//Save writes into a temporary file first, so a crash
+//can never leave a corrupt checkpoint behind
+func (f fileCheckpointStore) Save(ts bson.MongoTimestamp) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path))
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.WriteString(strconv.FormatInt(int64(ts), 10))
+	if err == nil {
+		//the data has to be on disk before the rename,
+		//otherwise a crash could leave an empty checkpoint
+		err = tmp.Sync()
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path)
+}
+
+//NewCheckpointStore creates the store defined in the settings
+//it will return nil if no checkpoint type is configured
+func NewCheckpointStore(c CheckpointSettings, session *mgo.Session) (CheckpointStore, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	switch c.Type {
+	case "file":
+		return fileCheckpointStore{path: c.Path}, nil
+	case "mongo":
+		p := strings.Index(c.Collection, ".")
+		id := c.Name
+		if id == "" {
+			id = defaultCheckpointName
+		}
+
+		return mongoCheckpointStore{
+			session:  session,
+			database: c.Collection[:p],
+			name:     c.Collection[p+1:],
+			id:       id,
+		}, nil
+	}
+
+	return nil, nil
+}
+
+//pendingWindow keeps track of all oplog entries that are
+//currently being analyzed. The checkpoint may only advance
+//up to the newest entry that has no unfinished predecessor.
+type pendingWindow struct {
+	sync.Mutex
+	pending  []*pendingEntry
+	done     bson.MongoTimestamp
+	reported bson.MongoTimestamp
+}
+
+type pendingEntry struct {
+	ts       bson.MongoTimestamp
+	finished bool
+}
+
+func newPendingWindow(start bson.MongoTimestamp) *pendingWindow {
+	return &pendingWindow{done: start, reported: start}
+}
+
+func (p *pendingWindow) add(ts bson.MongoTimestamp) *pendingEntry {
+	p.Lock()
+	defer p.Unlock()
+
+	e := &pendingEntry{ts: ts}
+	p.pending = append(p.pending, e)
+
+	return e
+}
+
+func (p *pendingWindow) finish(e *pendingEntry) {
+	p.Lock()
+	defer p.Unlock()
+
+	e.finished = true
+	for len(p.pending) > 0 && p.pending[0].finished {
+		p.done = p.pending[0].ts
+		p.pending[0] = nil
+		p.pending = p.pending[1:]
+	}
+}
+
+//advanced returns the newest completely processed timestamp
+//and whether it changed since it has been saved the last time
+func (p *pendingWindow) advanced() (bson.MongoTimestamp, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.done, p.done != p.reported
+}
+
+//saved marks ts as persisted, advanced only reports newer timestamps afterwards
+func (p *pendingWindow) saved(ts bson.MongoTimestamp) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.reported = ts
+}
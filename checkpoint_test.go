@@ -0,0 +1,56 @@
+package redkeep_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/manyminds/redkeep"
+	"gopkg.in/mgo.v2/bson"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Checkpoint tests", func() {
+	Context("file checkpoints", func() {
+		var (
+			dir   string
+			store CheckpointStore
+		)
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "redkeep")
+			Expect(err).ToNot(HaveOccurred())
+
+			store, err = NewCheckpointStore(CheckpointSettings{Type: "file", Path: filepath.Join(dir, "checkpoint")}, nil)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("will start with an empty checkpoint", func() {
+			ts, err := store.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ts).To(Equal(bson.MongoTimestamp(0)))
+		})
+
+		It("will load the last saved timestamp", func() {
+			Expect(store.Save(bson.MongoTimestamp(6245436546017525761))).To(Succeed())
+			Expect(store.Save(bson.MongoTimestamp(6245436546017525762))).To(Succeed())
+
+			ts, err := store.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ts).To(Equal(bson.MongoTimestamp(6245436546017525762)))
+		})
+	})
+
+	It("will not create a store without type", func() {
+		store, err := NewCheckpointStore(CheckpointSettings{}, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(store).To(BeNil())
+	})
+})
@@ -0,0 +1,40 @@
+package redkeep
+
+import (
+	"gopkg.in/mgo.v2/bson"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Pending window tests", func() {
+	It("will not advance beyond an unfinished entry", func() {
+		window := newPendingWindow(bson.MongoTimestamp(1))
+		first := window.add(bson.MongoTimestamp(2))
+		second := window.add(bson.MongoTimestamp(3))
+
+		window.finish(second)
+		ts, changed := window.advanced()
+		Expect(ts).To(Equal(bson.MongoTimestamp(1)))
+		Expect(changed).To(BeFalse())
+
+		window.finish(first)
+		ts, changed = window.advanced()
+		Expect(ts).To(Equal(bson.MongoTimestamp(3)))
+		Expect(changed).To(BeTrue())
+	})
+
+	It("will report the timestamp again until it has been saved", func() {
+		window := newPendingWindow(bson.MongoTimestamp(1))
+		window.finish(window.add(bson.MongoTimestamp(2)))
+
+		_, changed := window.advanced()
+		Expect(changed).To(BeTrue())
+		_, changed = window.advanced()
+		Expect(changed).To(BeTrue())
+
+		window.saved(bson.MongoTimestamp(2))
+		_, changed = window.advanced()
+		Expect(changed).To(BeFalse())
+	})
+})
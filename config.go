@@ -3,14 +3,20 @@ package redkeep
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
 
 	validator "gopkg.in/go-playground/validator.v8"
 )
 
 //Configuration for red keep
 type Configuration struct {
-	Mongo   Mongo   `json:"mongo" validate:"required"`
-	Watches []Watch `json:"watches" validate:"required,gt=0,dive"`
+	Mongo      Mongo              `json:"mongo" validate:"required"`
+	Checkpoint CheckpointSettings `json:"checkpoint"`
+	Agent      AgentSettings      `json:"agent"`
+	Watches    []Watch            `json:"watches" validate:"required,gt=0,dive"`
 }
 
 //Mongo is a config struct that changes the way the client
@@ -23,21 +29,516 @@ type Mongo struct {
 	ConnectionURI string `json:"connectionURI" validate:"required,gt=0"`
 }
 
+//CheckpointSettings defines where redkeep stores the timestamp
+//of the last completely processed oplog entry, so a restarted
+//agent can resume where it stopped.
+//Type is either "mongo" or "file", leave it empty to disable checkpoints.
+//Collection (database.collection) and Name (the document id, default redkeep)
+//are used by type mongo, Path by type file.
+type CheckpointSettings struct {
+	Type       string `json:"type"`
+	Collection string `json:"collection"`
+	Name       string `json:"name"`
+	Path       string `json:"path"`
+}
+
+func (c CheckpointSettings) validate() error {
+	switch c.Type {
+	case "":
+		return nil
+	case "mongo":
+		if !strings.Contains(c.Collection, ".") {
+			return errors.New("Checkpoint collection must be in the scheme database.collection")
+		}
+	case "file":
+		if c.Path == "" {
+			return errors.New("Checkpoint path must not be empty")
+		}
+	default:
+		return errors.New("Checkpoint type must be either mongo or file")
+	}
+
+	return nil
+}
+
+//AgentSettings tune the tail agent.
+//Workers is the number of oplog entries that are analyzed in
+//parallel (default 8), QueueSize the number of entries each worker
+//buffers before tailing blocks (default 100).
+//ShutdownGracePeriod is the time queued entries may take to be
+//analyzed after the agent was stopped (default 10s).
+//ForceRescan starts tailing at the beginning of the oplog.
+//BackfillOnGap backfills all watches if the oplog does not
+//reach back to the checkpoint anymore, instead of stopping.
+//DryRun writes all queries as JSON lines to DryRunOutput
+//(stdout if empty) instead of executing them, the checkpoint
+//will not be saved.
+type AgentSettings struct {
+	Workers             int               `json:"workers"`
+	QueueSize           int               `json:"queueSize"`
+	ShutdownGracePeriod string            `json:"shutdownGracePeriod"`
+	ForceRescan         bool              `json:"forceRescan"`
+	BackfillOnGap       bool              `json:"backfillOnGap"`
+	DryRun              bool              `json:"dryRun"`
+	DryRunOutput        string            `json:"dryRunOutput"`
+	Reconnect           ReconnectSettings `json:"reconnect"`
+}
+
+//ReconnectSettings define how the agent reconnects if the oplog cursor
+//fails. The delay starts at InitialBackoff (default 1s) and doubles with
+//every failed attempt up to MaxBackoff (default 1m). The agent gives up
+//after MaxRetries failed attempts in a row (default 10, -1 retries forever).
+type ReconnectSettings struct {
+	InitialBackoff string `json:"initialBackoff"`
+	MaxBackoff     string `json:"maxBackoff"`
+	MaxRetries     int    `json:"maxRetries"`
+}
+
+const (
+	defaultGracePeriod    = 10 * time.Second
+	defaultInitialBackoff = 1 * time.Second
+	defaultMaxBackoff     = 1 * time.Minute
+	defaultMaxRetries     = 10
+)
+
+//Backoff returns the delay before reconnect attempt (starting at 1),
+//a random jitter of up to half of the delay is subtracted
+func (r ReconnectSettings) Backoff(attempt int) time.Duration {
+	delay, err := time.ParseDuration(r.InitialBackoff)
+	if err != nil {
+		delay = defaultInitialBackoff
+	}
+
+	max, err := time.ParseDuration(r.MaxBackoff)
+	if err != nil {
+		max = defaultMaxBackoff
+	}
+
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+
+	if delay > max {
+		delay = max
+	}
+
+	if delay < 2 {
+		return delay
+	}
+
+	return delay - time.Duration(rand.Int63n(int64(delay/2)))
+}
+
+//Retries returns whether attempt is within the retry budget
+func (r ReconnectSettings) Retries(attempt int) bool {
+	switch {
+	case r.MaxRetries < 0:
+		return true
+	case r.MaxRetries == 0:
+		return attempt <= defaultMaxRetries
+	}
+
+	return attempt <= r.MaxRetries
+}
+
+func (r ReconnectSettings) validate() error {
+	for _, d := range []string{r.InitialBackoff, r.MaxBackoff} {
+		if d == "" {
+			continue
+		}
+
+		if parsed, err := time.ParseDuration(d); err != nil || parsed <= 0 {
+			return errors.New("Reconnect backoffs must be valid durations like 1s")
+		}
+	}
+
+	return nil
+}
+
+//GracePeriod returns the parsed ShutdownGracePeriod
+func (a AgentSettings) GracePeriod() time.Duration {
+	d, err := time.ParseDuration(a.ShutdownGracePeriod)
+	if err != nil {
+		return defaultGracePeriod
+	}
+
+	return d
+}
+
+func (a AgentSettings) validate() error {
+	if a.Workers < 0 {
+		return errors.New("Workers must not be negative")
+	}
+
+	if a.QueueSize < 0 {
+		return errors.New("QueueSize must not be negative")
+	}
+
+	if a.ShutdownGracePeriod != "" {
+		if d, err := time.ParseDuration(a.ShutdownGracePeriod); err != nil || d < 0 {
+			return errors.New("ShutdownGracePeriod must be a valid duration like 10s")
+		}
+	}
+
+	return a.Reconnect.validate()
+}
+
 //Watch defines one watch that redkeep will do for you
 type Watch struct {
 	//TODO validate collections to be in this scheme: database.collection
 	TrackCollection       string            `json:"trackCollection" validate:"required,gt=0"`
-	TrackFields           []string          `json:"trackFields" validate:"required,min=1,dive,min=1"`
+	TrackFields           []string          `json:"trackFields" validate:"dive,min=1"`
+	ExcludeFields         []string          `json:"excludeFields"`
+	FieldMapping          map[string]string `json:"fieldMapping"`
+	Transforms            map[string]string `json:"transforms"`
 	TargetCollection      string            `json:"targetCollection" validate:"required,min=1"`
 	TargetNormalizedField string            `json:"targetNormalizedField" validate:"required,min=1"`
 	TriggerReference      string            `json:"triggerReference" validate:"required,min=1"`
+	ReferenceType         string            `json:"referenceType"`
+	ReferenceField        string            `json:"referenceField"`
+	ReferenceArray        bool              `json:"referenceArray"`
 	BehaviourSettings     BehaviourSettings `json:"behaviourSettings"`
+	Kind                  string            `json:"kind"`
+	Summary               SummarySettings   `json:"summary"`
+	Aggregate             AggregateSettings `json:"aggregate"`
+	Via                   []Hop             `json:"via"`
+}
+
+//AggregateSettings configure watches of kind aggregate
+//Function is one of count, sum, min, max or lastModified, Field the
+//aggregated field of the referencing documents. IndexCollection stores
+//which document every referencing document references, it defaults to
+//redkeepReferences in the database of the target collection.
+type AggregateSettings struct {
+	Function        string `json:"function"`
+	Field           string `json:"field"`
+	IndexCollection string `json:"indexCollection"`
+}
+
+//SummarySettings configure watches of kind summary
+//Limit is the number of summarized documents (default 10),
+//they are the ones with the highest SortBy (default _id).
+type SummarySettings struct {
+	Limit  int    `json:"limit"`
+	SortBy string `json:"sortBy"`
+}
+
+//validate checks everything that can not be expressed
+//with validation tags
+func (w Watch) validate() error {
+	switch w.Kind {
+	case "", WatchKindCopy:
+	case WatchKindSummary:
+		if err := w.validateSummary(); err != nil {
+			return err
+		}
+	case WatchKindAggregate:
+		if err := w.validateAggregate(); err != nil {
+			return err
+		}
+	default:
+		return errors.New("Kind must be one of copy, summary or aggregate")
+	}
+
+	if err := w.validateVia(); err != nil {
+		return err
+	}
+
+	//aggregates like count do not need any field
+	if len(w.TrackFields) == 0 && !isAggregate(w) {
+		return errors.New("TrackFields must contain at least one field")
+	}
+
+	switch w.ReferenceType {
+	case "", ReferenceDBRef, ReferenceObjectID, ReferenceString, ReferenceScalar:
+	default:
+		return errors.New("ReferenceType must be one of dbref, objectId, string or scalar")
+	}
+
+	if strings.Contains(w.TriggerReference, "$[]") {
+		if _, _, ok := embeddedPath(w.TriggerReference); !ok || strings.Count(w.TriggerReference, "$[]") != 1 {
+			return errors.New("TriggerReference must be either a field or in the scheme array.$[].field")
+		}
+
+		if w.ReferenceArray {
+			return errors.New("ReferenceArray can not be combined with references inside of arrays")
+		}
+	}
+
+	if w.ReferenceField != "" && w.ReferenceType != ReferenceScalar {
+		return errors.New("ReferenceField can only be used with ReferenceType scalar")
+	}
+
+	//a removed document can not be loaded anymore, so its
+	//targets can only be found by its id
+	if referenceField(w) != "_id" && w.BehaviourSettings.DeletePolicy() != OnDeleteKeep {
+		return errors.New("OnDelete requires ReferenceField to be _id")
+	}
+
+	if err := w.validateTrackFields(); err != nil {
+		return err
+	}
+
+	if err := w.validateFieldMapping(); err != nil {
+		return err
+	}
+
+	if err := w.validateTransforms(); err != nil {
+		return err
+	}
+
+	return w.BehaviourSettings.validate()
+}
+
+//validateReverse checks the settings all watches have in common that
+//update the referenced document, they do not support references inside
+//of arrays and delete policies. kind is used in the error messages.
+func (w Watch) validateReverse(kind string) error {
+	if w.ReferenceArray || strings.Contains(w.TriggerReference, "$[]") {
+		return fmt.Errorf("%s do not support arrays of references", kind)
+	}
+
+	if w.BehaviourSettings.DeletePolicy() != OnDeleteKeep {
+		return fmt.Errorf("%s are always updated on delete, OnDelete can not be used", kind)
+	}
+
+	return nil
+}
+
+//validateAggregate checks the settings that are only used by aggregates
+func (w Watch) validateAggregate() error {
+	if err := w.validateReverse("Aggregates"); err != nil {
+		return err
+	}
+
+	switch w.Aggregate.Function {
+	case AggregateCount:
+	case AggregateSum, AggregateMin, AggregateMax:
+		if !validPath(w.Aggregate.Field) {
+			return errors.New("Aggregate field must be a valid field, it is required for sum, min and max")
+		}
+	case AggregateLastModified:
+		if w.Aggregate.Field != "" && !validPath(w.Aggregate.Field) {
+			return errors.New("Aggregate field of lastModified must be a valid field")
+		}
+	default:
+		return errors.New("Aggregate function must be one of count, sum, min, max or lastModified")
+	}
+
+	if w.Aggregate.IndexCollection != "" && strings.Count(w.Aggregate.IndexCollection, ".") < 1 {
+		return errors.New("Aggregate indexCollection must be in the scheme database.collection")
+	}
+
+	return nil
+}
+
+//validateSummary checks the settings that are only used by summaries
+func (w Watch) validateSummary() error {
+	if err := w.validateReverse("Summaries"); err != nil {
+		return err
+	}
+
+	if w.Summary.Limit < 0 {
+		return errors.New("Summary limit must not be negative")
+	}
+
+	if w.Summary.SortBy != "" && !validPath(w.Summary.SortBy) {
+		return errors.New("Summary sortBy must be a valid field")
+	}
+
+	return nil
+}
+
+//validateTransforms parses every transform and ensures
+//that they are not stored in the place of tracked fields
+func (w Watch) validateTransforms() error {
+	if len(w.Transforms) == 0 {
+		return nil
+	}
+
+	//transforms could collide with any field of the tracked document
+	if checkKey(w.TrackFields, allFields) {
+		return errors.New("Transforms can not be combined with tracking all fields")
+	}
+
+	for name, text := range w.Transforms {
+		if !validPath(name) {
+			return fmt.Errorf("Transforms must be named like valid fields, %s is not", name)
+		}
+
+		if _, err := parseTransform(text); err != nil {
+			return fmt.Errorf("Transform %s is invalid: %s", name, err)
+		}
+
+		for _, field := range trackedFields(w) {
+			mapped := mappedField(w, field)
+			if mapped == name || strings.HasPrefix(mapped, name+".") || strings.HasPrefix(name, mapped+".") {
+				return fmt.Errorf("Transform %s overlaps the tracked field %s", name, field)
+			}
+		}
+	}
+
+	return nil
+}
+
+//validateTrackFields ensures that every tracked field is a valid path
+//and tracked only once, a field may be tracked with one of its parents.
+//* may only be used as last part like profile.* or alone.
+func (w Watch) validateTrackFields() error {
+	seen := map[string]bool{}
+	for _, field := range w.TrackFields {
+		if !validPath(strings.TrimSuffix(field, ".*")) && field != allFields {
+			return fmt.Errorf("TrackFields must be valid paths like profile.avatar or profile.*, %s is not", field)
+		}
+
+		canonical := strings.TrimSuffix(field, ".*")
+		if seen[canonical] {
+			return fmt.Errorf("TrackFields must not contain %s twice", canonical)
+		}
+
+		seen[canonical] = true
+	}
+
+	for _, field := range w.ExcludeFields {
+		if !validPath(field) {
+			return fmt.Errorf("ExcludeFields must be valid paths like profile.secret, %s is not", field)
+		}
+	}
+
+	return nil
+}
+
+//validPath returns true if path is a field
+//path like profile.avatar without operators
+func validPath(path string) bool {
+	for _, part := range strings.Split(path, ".") {
+		if part == "" || strings.HasPrefix(part, "$") || part == allFields {
+			return false
+		}
+	}
+
+	return true
+}
+
+//validateFieldMapping ensures that every mapped field is tracked
+//and no two tracked fields are copied to the same place
+func (w Watch) validateFieldMapping() error {
+	for from, to := range w.FieldMapping {
+		tracked := false
+		for _, field := range trackedFields(w) {
+			tracked = tracked || field == from
+		}
+
+		if !tracked {
+			return errors.New("FieldMapping can only rename tracked fields")
+		}
+
+		for _, part := range strings.Split(to, ".") {
+			if part == "" || strings.HasPrefix(part, "$") {
+				return errors.New("FieldMapping must map to valid field names")
+			}
+		}
+	}
+
+	if len(w.FieldMapping) == 0 {
+		return nil
+	}
+
+	//mapped names could collide with any field of the tracked document
+	if checkKey(w.TrackFields, allFields) {
+		return errors.New("FieldMapping can not be combined with tracking all fields")
+	}
+
+	fields := trackedFields(w)
+	for i, a := range fields {
+		for _, b := range fields[i+1:] {
+			mappedA, mappedB := mappedField(w, a), mappedField(w, b)
+			if mappedA == mappedB {
+				return fmt.Errorf("FieldMapping maps %s and %s both to %s", a, b, mappedA)
+			}
+
+			//children keep their position inside of their parent
+			if strings.HasPrefix(a, b+".") || strings.HasPrefix(b, a+".") {
+				continue
+			}
+
+			if strings.HasPrefix(mappedA, mappedB+".") || strings.HasPrefix(mappedB, mappedA+".") {
+				return fmt.Errorf("FieldMapping maps %s and %s to overlapping fields %s and %s", a, b, mappedA, mappedB)
+			}
+		}
+	}
+
+	return nil
 }
 
 //BehaviourSettings can define how one specific
 //watch handles special cases
+//OnDelete chooses what happens to the targets if the tracked document
+//gets removed, CascadeDelete is a shortcut for OnDeleteRemove.
+//Tombstone is the value used by OnDeleteMarkOrphaned, it defaults to
+//{"deleted": true}, deletedAt will always be set.
+//UpdateMode chooses how updates of the tracked document are applied.
 type BehaviourSettings struct {
-	CascadeDelete bool `json:"cascadeDelete"`
+	CascadeDelete bool                   `json:"cascadeDelete"`
+	OnDelete      string                 `json:"onDelete"`
+	Tombstone     map[string]interface{} `json:"tombstone"`
+	UpdateMode    string                 `json:"updateMode"`
+}
+
+//all possible UpdateModes
+const (
+	//UpdateModeReplay translates the update operators of the oplog (default)
+	UpdateModeReplay = "replay"
+	//UpdateModeRefetch loads the tracked document and rewrites the whole
+	//TargetNormalizedField whenever a tracked field changes
+	UpdateModeRefetch = "refetch"
+)
+
+//all possible OnDelete policies
+const (
+	//OnDeleteKeep leaves the targets untouched
+	OnDeleteKeep = "keep"
+	//OnDeleteRemove removes all targets
+	OnDeleteRemove = "remove"
+	//OnDeleteUnset removes the TargetNormalizedField of all targets
+	OnDeleteUnset = "unset"
+	//OnDeleteMarkOrphaned replaces the TargetNormalizedField with a tombstone
+	OnDeleteMarkOrphaned = "markOrphaned"
+	//OnDeleteNullify sets the TriggerReference of all targets to null
+	OnDeleteNullify = "nullify"
+)
+
+//DeletePolicy returns the OnDelete policy that will be used
+func (b BehaviourSettings) DeletePolicy() string {
+	if b.OnDelete != "" {
+		return b.OnDelete
+	}
+
+	if b.CascadeDelete {
+		return OnDeleteRemove
+	}
+
+	return OnDeleteKeep
+}
+
+func (b BehaviourSettings) validate() error {
+	switch b.OnDelete {
+	case "", OnDeleteKeep, OnDeleteRemove, OnDeleteUnset, OnDeleteMarkOrphaned, OnDeleteNullify:
+	default:
+		return errors.New("OnDelete must be one of keep, remove, unset, markOrphaned or nullify")
+	}
+
+	if b.CascadeDelete && b.DeletePolicy() != OnDeleteRemove {
+		return errors.New("CascadeDelete can only be combined with OnDelete remove")
+	}
+
+	switch b.UpdateMode {
+	case "", UpdateModeReplay, UpdateModeRefetch:
+	default:
+		return errors.New("UpdateMode must be either replay or refetch")
+	}
+
+	return nil
 }
 
 //NewConfiguration loads a configuration from data
@@ -56,11 +557,38 @@ func NewConfiguration(configData []byte) (*Configuration, error) {
 		return nil, getValidationError(err.(validator.ValidationErrors))
 	}
 
-	return &config, err
+	if err := config.Checkpoint.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := config.Agent.validate(); err != nil {
+		return nil, err
+	}
+
+	for _, w := range config.Watches {
+		if err := w.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if cycle := findCycle(config.Watches); cycle != nil {
+		parts := make([]string, len(cycle))
+		for i, index := range cycle {
+			parts[i] = fmt.Sprint(index)
+		}
+
+		return nil, fmt.Errorf("Watches %s update each other in a cycle", strings.Join(parts, " -> "))
+	}
+
+	return &config, nil
 }
 
 func getValidationError(allErrors validator.ValidationErrors) error {
 	for _, e := range allErrors {
+		if strings.HasPrefix(e.Field, "TrackFields[") {
+			return errors.New("TrackFields must not contain empty fields")
+		}
+
 		switch e.Field {
 		case "Watches":
 			return errors.New("Please add atleast one entry in watches")
@@ -73,9 +601,7 @@ func getValidationError(allErrors validator.ValidationErrors) error {
 		case "TrackCollection":
 			return errors.New("TrackCollection must not be empty")
 		case "TrackFields":
-			fallthrough
-		case "TrackFields[0]":
-			return errors.New("TrackFields must exactly have one non-empty field, more are currently not supported")
+			return errors.New("TrackFields must contain at least one field")
 		case "TargetNormalizedField":
 			return errors.New("TargetNormalizedField must not be empty")
 		default:
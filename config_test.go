@@ -3,6 +3,7 @@ package redkeep_test
 import (
 	"io/ioutil"
 	"strings"
+	"time"
 
 	. "github.com/manyminds/redkeep"
 
@@ -103,13 +104,341 @@ var _ = Describe("Config Testsuite", func() {
 		It("will error with correct data but empty trigger", func() {
 			_, err := NewConfiguration([]byte(strings.Replace(templateForTestsConfig, "xBx", "", 1)))
 			Expect(err).To(HaveOccurred())
-			Expect(err.Error()).To(Equal("TrackFields must exactly have one non-empty field, more are currently not supported"))
+			Expect(err.Error()).To(Equal("TrackFields must not contain empty fields"))
 		})
 
-		It("will error with correct data but multiple trackFields", func() {
+		It("will error with correct data but multiple trackFields with an empty one", func() {
 			_, err := NewConfiguration([]byte(strings.Replace(templateForTestsConfig, `xBx"`, `", "xXx"`, 1)))
 			Expect(err).To(HaveOccurred())
-			Expect(err.Error()).To(Equal("TrackFields must exactly have one non-empty field, more are currently not supported"))
+			Expect(err.Error()).To(Equal("TrackFields must not contain empty fields"))
+		})
+
+		It("will error without trackFields", func() {
+			_, err := NewConfiguration([]byte(strings.Replace(templateForTestsConfig, `["xBx"]`, `[]`, 1)))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("TrackFields must contain at least one field"))
+		})
+
+		It("will accept multiple and overlapping trackFields", func() {
+			config := strings.Replace(templateForTestsConfig, `"xBx"`, `"username", "profile", "profile.avatar"`, 1)
+			c, err := NewConfiguration([]byte(config))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Watches[0].TrackFields).To(Equal([]string{"username", "profile", "profile.avatar"}))
+		})
+
+		It("will error with duplicate trackFields", func() {
+			config := strings.Replace(templateForTestsConfig, `"xBx"`, `"username", "username"`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("TrackFields must not contain username twice"))
+		})
+
+		It("will accept wildcards and excluded fields", func() {
+			config := strings.Replace(templateForTestsConfig, `"xBx"`, `"*", "profile.*"], "excludeFields": ["passwordHash"`, 1)
+			c, err := NewConfiguration([]byte(config))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Watches[0].ExcludeFields).To(Equal([]string{"passwordHash"}))
+		})
+
+		It("will error with wildcards in the middle of trackFields", func() {
+			config := strings.Replace(templateForTestsConfig, `"xBx"`, `"addresses.*.city"`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("TrackFields must be valid paths like profile.avatar or profile.*, addresses.*.city is not"))
+		})
+
+		It("will error with a field tracked as wildcard and field", func() {
+			config := strings.Replace(templateForTestsConfig, `"xBx"`, `"profile", "profile.*"`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("TrackFields must not contain profile twice"))
+		})
+
+		It("will error with invalid excluded fields", func() {
+			config := strings.Replace(templateForTestsConfig, `"xBx"]`, `"*"], "excludeFields": ["profile.*"]`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("ExcludeFields must be valid paths like profile.secret, profile.* is not"))
+		})
+
+		It("will error with invalid trackField paths", func() {
+			config := strings.Replace(templateForTestsConfig, `"xBx"`, `"profile..avatar"`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("TrackFields must be valid paths like profile.avatar or profile.*, profile..avatar is not"))
+		})
+
+		It("will error with an unknown checkpoint type", func() {
+			config := strings.Replace(templateForTestsConfig, `"watches"`, `"checkpoint": {"type": "redis"}, "watches"`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Checkpoint type must be either mongo or file"))
+		})
+
+		It("will error with a checkpoint collection without database", func() {
+			config := strings.Replace(templateForTestsConfig, `"watches"`, `"checkpoint": {"type": "mongo", "collection": "checkpoint"}, "watches"`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Checkpoint collection must be in the scheme database.collection"))
+		})
+
+		It("will error with a file checkpoint without path", func() {
+			config := strings.Replace(templateForTestsConfig, `"watches"`, `"checkpoint": {"type": "file"}, "watches"`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Checkpoint path must not be empty"))
+		})
+
+		It("will error with negative workers", func() {
+			config := strings.Replace(templateForTestsConfig, `"watches"`, `"agent": {"workers": -1}, "watches"`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Workers must not be negative"))
+		})
+
+		It("will error with an invalid shutdownGracePeriod", func() {
+			config := strings.Replace(templateForTestsConfig, `"watches"`, `"agent": {"shutdownGracePeriod": "soon"}, "watches"`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("ShutdownGracePeriod must be a valid duration like 10s"))
+		})
+
+		It("will error with invalid reconnect backoffs", func() {
+			config := strings.Replace(templateForTestsConfig, `"watches"`, `"agent": {"reconnect": {"maxBackoff": "-1s"}}, "watches"`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Reconnect backoffs must be valid durations like 1s"))
+		})
+
+		It("will error with an unknown onDelete policy", func() {
+			config := strings.Replace(templateForTestsConfig, `"xEx"`, `"xEx", "behaviourSettings": {"onDelete": "drop"}`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("OnDelete must be one of keep, remove, unset, markOrphaned or nullify"))
+		})
+
+		It("will error with cascadeDelete and a different onDelete policy", func() {
+			config := strings.Replace(templateForTestsConfig, `"xEx"`, `"xEx", "behaviourSettings": {"cascadeDelete": true, "onDelete": "unset"}`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("CascadeDelete can only be combined with OnDelete remove"))
+		})
+
+		It("will error with an unknown updateMode", func() {
+			config := strings.Replace(templateForTestsConfig, `"xEx"`, `"xEx", "behaviourSettings": {"updateMode": "guess"}`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("UpdateMode must be either replay or refetch"))
+		})
+
+		It("will error with an unknown referenceType", func() {
+			config := strings.Replace(templateForTestsConfig, `"xEx"`, `"xEx", "referenceType": "guid"`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("ReferenceType must be one of dbref, objectId, string or scalar"))
+		})
+
+		It("will error with a referenceField for non scalar references", func() {
+			config := strings.Replace(templateForTestsConfig, `"xEx"`, `"xEx", "referenceType": "objectId", "referenceField": "email"`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("ReferenceField can only be used with ReferenceType scalar"))
+		})
+
+		It("will error with onDelete and a scalar reference on another field than _id", func() {
+			config := strings.Replace(templateForTestsConfig, `"xEx"`, `"xEx", "referenceType": "scalar", "referenceField": "email", "behaviourSettings": {"onDelete": "unset"}`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("OnDelete requires ReferenceField to be _id"))
+		})
+
+		It("will error with an invalid reference inside of arrays", func() {
+			config := strings.Replace(templateForTestsConfig, `"xEx"`, `"answers.$[].author.$[].user"`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("TriggerReference must be either a field or in the scheme array.$[].field"))
+		})
+
+		It("will error with an array of references inside of arrays", func() {
+			config := strings.Replace(templateForTestsConfig, `"xEx"`, `"answers.$[].author", "referenceArray": true`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("ReferenceArray can not be combined with references inside of arrays"))
+		})
+
+		It("will error with a field mapping of untracked fields", func() {
+			config := strings.Replace(templateForTestsConfig, `"xEx"`, `"xEx", "fieldMapping": {"email": "mail"}`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("FieldMapping can only rename tracked fields"))
+		})
+
+		It("will error with colliding field mappings", func() {
+			config := strings.Replace(templateForTestsConfig, `"xEx"`, `"xEx", "fieldMapping": {"name": "username"}`, 1)
+			config = strings.Replace(config, `"xBx"`, `"name", "username"`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("FieldMapping maps name and username both to username"))
+		})
+
+		It("will error with invalid transforms", func() {
+			config := strings.Replace(templateForTestsConfig, `"xEx"`, `"xEx", "transforms": {"displayName": "{{.name.firstName"}`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Transform displayName is invalid: "))
+		})
+
+		It("will error with transforms in the place of tracked fields", func() {
+			config := strings.Replace(templateForTestsConfig, `"xEx"`, `"xEx", "transforms": {"xBx": "{{upper .xBx}}"}`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Transform xBx overlaps the tracked field xBx"))
+		})
+
+		It("will error with an unknown kind", func() {
+			config := strings.Replace(templateForTestsConfig, `"xEx"`, `"xEx", "kind": "mirror"`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Kind must be one of copy, summary or aggregate"))
+		})
+
+		It("will error with summaries of arrays of references", func() {
+			config := strings.Replace(templateForTestsConfig, `"xEx"`, `"xEx", "kind": "summary", "referenceArray": true`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Summaries do not support arrays of references"))
+		})
+
+		It("will error with summaries and onDelete", func() {
+			config := strings.Replace(templateForTestsConfig, `"xEx"`, `"xEx", "kind": "summary", "behaviourSettings": {"cascadeDelete": true}`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Summaries are always updated on delete, OnDelete can not be used"))
+		})
+
+		It("will accept summaries", func() {
+			config := strings.Replace(templateForTestsConfig, `"xEx"`, `"xEx", "kind": "summary", "summary": {"limit": 5, "sortBy": "createdAt"}`, 1)
+			c, err := NewConfiguration([]byte(config))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Watches[0].Summary).To(Equal(SummarySettings{Limit: 5, SortBy: "createdAt"}))
+		})
+
+		It("will error with an unknown aggregate function", func() {
+			config := strings.Replace(templateForTestsConfig, `"xEx"`, `"xEx", "kind": "aggregate", "aggregate": {"function": "avg"}`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Aggregate function must be one of count, sum, min, max or lastModified"))
+		})
+
+		It("will error with sum aggregates without field", func() {
+			config := strings.Replace(templateForTestsConfig, `"xEx"`, `"xEx", "kind": "aggregate", "aggregate": {"function": "sum"}`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Aggregate field must be a valid field, it is required for sum, min and max"))
+		})
+
+		It("will error with lastModified aggregates with an invalid field", func() {
+			config := strings.Replace(templateForTestsConfig, `"xEx"`, `"xEx", "kind": "aggregate", "aggregate": {"function": "lastModified", "field": "$updatedAt"}`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Aggregate field of lastModified must be a valid field"))
+		})
+
+		It("will accept count aggregates without trackFields", func() {
+			config := strings.Replace(templateForTestsConfig, `"xEx"`, `"xEx", "kind": "aggregate", "aggregate": {"function": "count"}`, 1)
+			config = strings.Replace(config, `["xBx"]`, `[]`, 1)
+			c, err := NewConfiguration([]byte(config))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Watches[0].Aggregate.Function).To(Equal(AggregateCount))
+		})
+
+		It("will accept watches that follow hops", func() {
+			config := strings.Replace(templateForTestsConfig, `"xEx"`, `"xEx", "via": [{"collection": "db.comment", "triggerReference": "user"}]`, 1)
+			c, err := NewConfiguration([]byte(config))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Watches[0].Via).To(Equal([]Hop{{Collection: "db.comment", TriggerReference: "user"}}))
+		})
+
+		It("will error with hops and references that are no DBRefs", func() {
+			config := strings.Replace(templateForTestsConfig, `"xEx"`, `"xEx", "referenceType": "objectId", "via": [{"collection": "db.comment", "triggerReference": "user"}]`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Via can only be used with single DBRef references"))
+		})
+
+		It("will error with hops in invalid collections", func() {
+			config := strings.Replace(templateForTestsConfig, `"xEx"`, `"xEx", "via": [{"collection": "comment", "triggerReference": "user"}]`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Via collections must be in the scheme database.collection"))
+		})
+
+		It("will error with a watch that updates itself", func() {
+			config := strings.Replace(templateForTestsConfig, `"xCx"`, `"xAx"`, 1)
+			config = strings.Replace(config, `["xBx"]`, `["*"]`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Watches 0 -> 0 update each other in a cycle"))
+		})
+
+		It("will error with watches that update each other", func() {
+			config := `{
+  "mongo": {"connectionURI": "localhost"},
+  "watches": [
+    {
+      "trackCollection": "db.user",
+      "trackFields": ["username", "company"],
+      "targetCollection": "db.company",
+      "targetNormalizedField": "owner",
+      "triggerReference": "ownerRef"
+    },
+    {
+      "trackCollection": "db.company",
+      "trackFields": ["name", "owner"],
+      "targetCollection": "db.user",
+      "targetNormalizedField": "company",
+      "triggerReference": "companyRef"
+    }
+  ]
+}`
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Watches 0 -> 1 -> 0 update each other in a cycle"))
+		})
+
+		It("will accept watches that write into the same collection without a cycle", func() {
+			config := strings.Replace(templateForTestsConfig, `"xCx"`, `"xAx"`, 1)
+			_, err := NewConfiguration([]byte(config))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("will accept a scalar reference", func() {
+			config := strings.Replace(templateForTestsConfig, `"xEx"`, `"xEx", "referenceType": "scalar", "referenceField": "email"`, 1)
+			c, err := NewConfiguration([]byte(config))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Watches[0].ReferenceType).To(Equal(ReferenceScalar))
+			Expect(c.Watches[0].ReferenceField).To(Equal("email"))
+		})
+
+		It("will use cascadeDelete as remove policy", func() {
+			config := strings.Replace(templateForTestsConfig, `"xEx"`, `"xEx", "behaviourSettings": {"cascadeDelete": true}`, 1)
+			c, err := NewConfiguration([]byte(config))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Watches[0].BehaviourSettings.DeletePolicy()).To(Equal(OnDeleteRemove))
+		})
+
+		It("will back off exponentially with jitter", func() {
+			r := ReconnectSettings{InitialBackoff: "100ms", MaxBackoff: "1s", MaxRetries: 3}
+			Expect(r.Backoff(1)).To(BeNumerically(">", 50*time.Millisecond))
+			Expect(r.Backoff(1)).To(BeNumerically("<=", 100*time.Millisecond))
+			Expect(r.Backoff(3)).To(BeNumerically(">", 200*time.Millisecond))
+			Expect(r.Backoff(3)).To(BeNumerically("<=", 400*time.Millisecond))
+			Expect(r.Backoff(10)).To(BeNumerically(">", 500*time.Millisecond))
+			Expect(r.Backoff(10)).To(BeNumerically("<=", time.Second))
+
+			Expect(r.Retries(3)).To(BeTrue())
+			Expect(r.Retries(4)).To(BeFalse())
+			Expect(ReconnectSettings{MaxRetries: -1}.Retries(1000)).To(BeTrue())
 		})
 
 		It("will load correctly", func() {
@@ -1,14 +1,21 @@
 package redkeep
 
 import (
+	"sort"
 	"strings"
 
 	"gopkg.in/mgo.v2/bson"
 )
 
+//allFields is the TrackFields entry that tracks every field except _id
+const allFields = "*"
+
+//checkKey returns true if field or one of its parents is in hackstack,
+//entries like profile.* match all fields below profile and * every field
 func checkKey(hackstack []string, field string) bool {
 	for _, b := range hackstack {
-		if b == field {
+		b = strings.TrimSuffix(b, ".*")
+		if b == allFields || b == field {
 			return true
 		}
 
@@ -20,15 +27,166 @@ func checkKey(hackstack []string, field string) bool {
 	return false
 }
 
+//trackedFields returns the TrackFields of w with profile.* written as profile
+func trackedFields(w Watch) []string {
+	result := make([]string, len(w.TrackFields))
+	for i, field := range w.TrackFields {
+		result[i] = strings.TrimSuffix(field, ".*")
+	}
+
+	return result
+}
+
+//isTracked returns true if changes of field have to be copied
+func isTracked(w Watch, field string) bool {
+	return checkKey(w.TrackFields, field) && !checkKey(w.ExcludeFields, field)
+}
+
+//withoutExcluded returns value without all excluded fields below field,
+//value is copied before anything is removed
+func withoutExcluded(w Watch, field string, value interface{}) interface{} {
+	document, ok := value.(map[string]interface{})
+	if !ok {
+		return value
+	}
+
+	result := map[string]interface{}{}
+	for key, child := range document {
+		path := key
+		if field != "" {
+			path = field + "." + key
+		}
+
+		if !checkKey(w.ExcludeFields, path) {
+			result[key] = withoutExcluded(w, path, child)
+		}
+	}
+
+	return result
+}
+
+//documentFields returns all fields of document that have to be copied.
+//* is expanded to all fields of document, excluded fields and fields
+//that are copied along with one of their tracked parents are skipped.
+func documentFields(w Watch, document map[string]interface{}) []string {
+	var fields []string
+	for _, field := range trackedFields(w) {
+		if field != allFields {
+			fields = append(fields, field)
+			continue
+		}
+
+		var keys []string
+		for key := range document {
+			if key != "_id" {
+				keys = append(keys, key)
+			}
+		}
+
+		sort.Strings(keys)
+		fields = append(fields, keys...)
+	}
+
+	var result []string
+	seen := map[string]bool{}
+	for _, field := range fields {
+		if seen[field] || checkKey(w.ExcludeFields, field) || copiedByParent(w, fields, field) {
+			continue
+		}
+
+		seen[field] = true
+		result = append(result, field)
+	}
+
+	return result
+}
+
+//mappedField returns the name of the copy of a tracked field or one of
+//its children relative to the normalized field, FieldMapping renames them
+func mappedField(w Watch, field string) string {
+	from := ""
+	for key := range w.FieldMapping {
+		if (field == key || strings.HasPrefix(field, key+".")) && len(key) > len(from) {
+			from = key
+		}
+	}
+
+	if from == "" {
+		return field
+	}
+
+	return w.FieldMapping[from] + field[len(from):]
+}
+
+//targetField returns the full path of the copy of field inside of the target
+func targetField(w Watch, field string) string {
+	return w.TargetNormalizedField + "." + mappedField(w, field)
+}
+
+//targetFields returns the paths of all copies of field inside of the target,
+//a renamed field is copied inside of its tracked parents as well
+func targetFields(w Watch, field string) []string {
+	paths := []string{targetField(w, field)}
+	for _, parent := range trackedFields(w) {
+		if !strings.HasPrefix(field, parent+".") {
+			continue
+		}
+
+		path := targetField(w, parent) + field[len(parent):]
+		known := false
+		for _, p := range paths {
+			known = known || p == path
+		}
+
+		if !known {
+			paths = append(paths, path)
+		}
+	}
+
+	return paths
+}
+
+//copiedByParent returns true if a parent of field
+//in fields already copies it to the same place
+func copiedByParent(w Watch, fields []string, field string) bool {
+	for _, parent := range fields {
+		if strings.HasPrefix(field, parent+".") && mappedField(w, field) == mappedField(w, parent)+field[len(parent):] {
+			return true
+		}
+	}
+
+	return false
+}
+
+//hidesTrackedField returns true if field is a parent of a
+//tracked field whose copy can not be updated along with it
+func hidesTrackedField(w Watch, field string) bool {
+	for _, t := range trackedFields(w) {
+		if !strings.HasPrefix(t, field+".") {
+			continue
+		}
+
+		if !isTracked(w, field) || mappedField(w, t) != mappedField(w, field)+t[len(field):] {
+			return true
+		}
+	}
+
+	return false
+}
+
 //BuildInsertQuery generates the query
 func BuildInsertQuery(w Watch, command map[string]interface{}) bson.M {
 	normalizingFields := bson.M{}
-	for key, value := range command {
-		if checkKey(w.TrackFields, key) {
-			normalizingFields[w.TargetNormalizedField+"."+key] = value
+	for _, field := range documentFields(w, command) {
+		if value, ok := lookupValue(field, command); ok {
+			normalizingFields[targetField(w, field)] = withoutExcluded(w, field, value)
 		}
 	}
 
+	for name, value := range transformValues(w, command) {
+		normalizingFields[w.TargetNormalizedField+"."+name] = value
+	}
+
 	if len(normalizingFields) == 0 {
 		return nil
 	}
@@ -37,23 +195,218 @@ func BuildInsertQuery(w Watch, command map[string]interface{}) bson.M {
 }
 
 //BuildUpdateQuery generates the query
+//all update operators in command ($set, $unset, $inc, $push, $rename...)
+//are translated into one combined update of the normalized fields
+//if command is a replacement document, BuildReplaceQuery is used instead
 func BuildUpdateQuery(w Watch, command map[string]interface{}) bson.M {
-	normalizingFields := bson.M{}
-	for queryType, query := range command {
-		if mappedQuery, ok := query.(map[string]interface{}); ok {
-			for key, value := range mappedQuery {
-				if checkKey(w.TrackFields, key) {
-					normalizingFields[w.TargetNormalizedField+"."+key] = value
+	if isReplacement(command) {
+		return BuildReplaceQuery(w, command)
+	}
+
+	result := bson.M{}
+	for operator, query := range command {
+		mappedQuery, ok := query.(map[string]interface{})
+		if !ok || !strings.HasPrefix(operator, "$") {
+			continue
+		}
+
+		if operator == "$rename" {
+			buildRenameQuery(w, mappedQuery, result)
+			continue
+		}
+
+		for key, value := range mappedQuery {
+			if isTracked(w, key) && !hasPositionalOperator(key) {
+				for _, path := range targetFields(w, key) {
+					addToQuery(result, operator, path, withoutExcluded(w, key, value))
+				}
+			}
+		}
+	}
+
+	if len(result) == 0 {
+		return nil
+	}
+
+	return result
+}
+
+//RequiresResync returns true if command changes tracked fields in a way
+//that BuildUpdateQuery can not translate. Positional operators ($, $[], $[id])
+//match array elements of the tracked document, not of the normalized copy,
+//$rename into a tracked field and updates of untracked or renamed parents
+//of tracked fields hide the new values. The normalized fields then have to be rebuilt
+//from the current source document.
+func RequiresResync(w Watch, command map[string]interface{}) bool {
+	if isReplacement(command) {
+		return false
+	}
+
+	for operator, query := range command {
+		mappedQuery, ok := query.(map[string]interface{})
+		if !ok || !strings.HasPrefix(operator, "$") {
+			continue
+		}
+
+		for key, value := range mappedQuery {
+			if isTracked(w, key) && hasPositionalOperator(key) {
+				return true
+			}
+
+			if hidesTrackedField(w, key) {
+				return true
+			}
+
+			if newName, ok := value.(string); ok && operator == "$rename" {
+				if !isTracked(w, key) && isTracked(w, newName) {
+					return true
 				}
+
+				//a single $rename can not move every copy
+				if len(targetFields(w, key)) > 1 || len(targetFields(w, newName)) > 1 {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+//hasPositionalOperator checks if one part of the
+//field path is an operator like $ or $[]
+func hasPositionalOperator(field string) bool {
+	for _, part := range strings.Split(field, ".") {
+		if strings.HasPrefix(part, "$") {
+			return true
+		}
+	}
+
+	return false
+}
+
+//isParentOfTrackedField returns true if field is a
+//parent document of at least one tracked field
+func isParentOfTrackedField(trackFields []string, field string) bool {
+	for _, t := range trackFields {
+		if strings.HasPrefix(t, field+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+//BuildReplaceQuery generates the query for a document that has
+//been replaced completely. Tracked fields missing in document
+//will be removed from the normalized field. Watches that track all
+//fields do not know which fields have been removed, they rewrite
+//the whole normalized field like BuildRefetchQuery.
+func BuildReplaceQuery(w Watch, document map[string]interface{}) bson.M {
+	if checkKey(w.TrackFields, allFields) {
+		return BuildRefetchQuery(w, document)
+	}
+
+	result := bson.M{}
+	for _, field := range documentFields(w, document) {
+		if value, ok := lookupValue(field, document); ok {
+			addToQuery(result, "$set", targetField(w, field), withoutExcluded(w, field, value))
+		} else {
+			addToQuery(result, "$unset", targetField(w, field), "")
+		}
+	}
+
+	for name, value := range transformValues(w, document) {
+		addToQuery(result, "$set", w.TargetNormalizedField+"."+name, value)
+	}
+
+	if len(result) == 0 {
+		return nil
+	}
+
+	return result
+}
+
+//BuildRefetchQuery generates a query that rewrites the
+//whole normalized field with the tracked fields of document
+func BuildRefetchQuery(w Watch, document map[string]interface{}) bson.M {
+	normalized := map[string]interface{}{}
+	for _, field := range documentFields(w, document) {
+		if value, ok := lookupValue(field, document); ok {
+			setValue(mappedField(w, field), normalized, withoutExcluded(w, field, value))
+		}
+	}
+
+	for name, value := range transformValues(w, document) {
+		setValue(name, normalized, value)
+	}
+
+	return bson.M{"$set": bson.M{w.TargetNormalizedField: normalized}}
+}
+
+//TouchesTrackedFields returns true if command
+//might change at least one tracked field
+func TouchesTrackedFields(w Watch, command map[string]interface{}) bool {
+	if isReplacement(command) || touchesTransforms(w, command) {
+		return true
+	}
+
+	for operator, query := range command {
+		mappedQuery, ok := query.(map[string]interface{})
+		if !ok || !strings.HasPrefix(operator, "$") {
+			continue
+		}
+
+		for key, value := range mappedQuery {
+			if isTracked(w, key) || isParentOfTrackedField(trackedFields(w), key) {
+				return true
+			}
+
+			if newName, ok := value.(string); ok && operator == "$rename" && isTracked(w, newName) {
+				return true
 			}
 		}
+	}
 
-		if len(normalizingFields) == 0 {
-			return nil
+	return false
+}
+
+//isReplacement returns true if command contains no update
+//operators, which means the whole document was replaced
+func isReplacement(command map[string]interface{}) bool {
+	for key := range command {
+		if strings.HasPrefix(key, "$") {
+			return false
 		}
+	}
+
+	return len(command) > 0
+}
+
+//buildRenameQuery translates $rename, if only the old name
+//is tracked the normalized field will be removed
+func buildRenameQuery(w Watch, renames map[string]interface{}, result bson.M) {
+	for from, to := range renames {
+		newName, ok := to.(string)
+		if !ok || !isTracked(w, from) {
+			continue
+		}
+
+		if isTracked(w, newName) {
+			addToQuery(result, "$rename", targetField(w, from), targetField(w, newName))
+			continue
+		}
+
+		addToQuery(result, "$unset", targetField(w, from), "")
+	}
+}
 
-		return bson.M{queryType: normalizingFields}
+func addToQuery(query bson.M, operator, key string, value interface{}) {
+	fields, ok := query[operator].(bson.M)
+	if !ok {
+		fields = bson.M{}
+		query[operator] = fields
 	}
 
-	return nil
+	fields[key] = value
 }
@@ -93,5 +93,445 @@ var _ = Describe("Querybuilder tests", func() {
 			actual := BuildUpdateQuery(w, command)
 			Expect(actual).To(Equal(expected))
 		})
+
+		It("will combine multiple operators", func() {
+			command := map[string]interface{}{
+				"$v": 1,
+				"$set": map[string]interface{}{
+					"username": "nino",
+				},
+				"$unset": map[string]interface{}{
+					"name":       true,
+					"otherField": true,
+				},
+			}
+
+			expected := bson.M{
+				"$set":   bson.M{"norm.username": "nino"},
+				"$unset": bson.M{"norm.name": true},
+			}
+			actual := BuildUpdateQuery(w, command)
+			Expect(actual).To(Equal(expected))
+		})
+
+		It("will translate other operators", func() {
+			command := map[string]interface{}{
+				"$inc": map[string]interface{}{
+					"invalid": 2,
+				},
+				"$push": map[string]interface{}{
+					"name.aliases": "Nino",
+				},
+				"$pull": map[string]interface{}{
+					"tags": "new",
+				},
+			}
+
+			expected := bson.M{
+				"$inc":  bson.M{"norm.invalid": 2},
+				"$push": bson.M{"norm.name.aliases": "Nino"},
+			}
+			actual := BuildUpdateQuery(w, command)
+			Expect(actual).To(Equal(expected))
+		})
+
+		It("will rename between tracked fields", func() {
+			command := map[string]interface{}{
+				"$rename": map[string]interface{}{
+					"name": "username",
+				},
+			}
+
+			expected := bson.M{"$rename": bson.M{"norm.name": "norm.username"}}
+			actual := BuildUpdateQuery(w, command)
+			Expect(actual).To(Equal(expected))
+		})
+
+		It("will unset fields renamed to untracked fields", func() {
+			command := map[string]interface{}{
+				"$unset": map[string]interface{}{
+					"invalid": "",
+				},
+				"$rename": map[string]interface{}{
+					"username": "nickname",
+				},
+			}
+
+			expected := bson.M{"$unset": bson.M{"norm.invalid": "", "norm.username": ""}}
+			actual := BuildUpdateQuery(w, command)
+			Expect(actual).To(Equal(expected))
+		})
+
+		It("will handle replacement documents", func() {
+			command := map[string]interface{}{
+				"_id":        "56a65494b204ccd1edc0b055",
+				"username":   "nino",
+				"otherField": "A",
+				"invalid":    nil,
+			}
+
+			expected := bson.M{
+				"$set":   bson.M{"norm.username": "nino", "norm.invalid": nil},
+				"$unset": bson.M{"norm.name": ""},
+			}
+			actual := BuildUpdateQuery(w, command)
+			Expect(actual).To(Equal(expected))
+		})
+
+		It("will handle nested fields in replacement documents", func() {
+			w.TrackFields = []string{"name.firstName", "name.lastName"}
+			command := map[string]interface{}{
+				"name": map[string]interface{}{
+					"firstName": "nino",
+				},
+			}
+
+			expected := bson.M{
+				"$set":   bson.M{"norm.name.firstName": "nino"},
+				"$unset": bson.M{"norm.name.lastName": ""},
+			}
+			actual := BuildReplaceQuery(w, command)
+			Expect(actual).To(Equal(expected))
+		})
+
+		It("will skip positional operators", func() {
+			w.TrackFields = []string{"username", "roles"}
+			command := map[string]interface{}{
+				"$set": map[string]interface{}{
+					"roles.$":  "admin",
+					"username": "nino",
+				},
+			}
+
+			expected := bson.M{"$set": bson.M{"norm.username": "nino"}}
+			Expect(BuildUpdateQuery(w, command)).To(Equal(expected))
+			Expect(RequiresResync(w, command)).To(BeTrue())
+		})
+
+		It("will translate array operators", func() {
+			w.TrackFields = []string{"roles"}
+			command := map[string]interface{}{
+				"$addToSet": map[string]interface{}{
+					"roles": map[string]interface{}{"$each": []interface{}{"admin", "moderator"}},
+				},
+			}
+
+			expected := bson.M{"$addToSet": bson.M{"norm.roles": map[string]interface{}{"$each": []interface{}{"admin", "moderator"}}}}
+			Expect(BuildUpdateQuery(w, command)).To(Equal(expected))
+			Expect(RequiresResync(w, command)).To(BeFalse())
+		})
+
+		It("will require a resync if untracked fields are renamed to tracked fields", func() {
+			command := map[string]interface{}{
+				"$rename": map[string]interface{}{
+					"fullName": "name",
+				},
+			}
+
+			Expect(BuildUpdateQuery(w, command)).To(BeNil())
+			Expect(RequiresResync(w, command)).To(BeTrue())
+		})
+
+		It("will require a resync if parents of tracked fields change", func() {
+			w.TrackFields = []string{"profile.avatar"}
+			command := map[string]interface{}{
+				"$set": map[string]interface{}{
+					"profile": map[string]interface{}{"avatar": "cat.png"},
+				},
+			}
+
+			Expect(RequiresResync(w, command)).To(BeTrue())
+		})
+
+		It("will not require a resync for simple updates", func() {
+			command := map[string]interface{}{
+				"$set": map[string]interface{}{
+					"username": "nino",
+				},
+				"$rename": map[string]interface{}{
+					"name": "username",
+				},
+			}
+
+			Expect(RequiresResync(w, command)).To(BeFalse())
+		})
+
+		It("will rewrite the whole normalized field on refetch", func() {
+			w.TrackFields = []string{"username", "name.firstName", "invalid"}
+			document := map[string]interface{}{
+				"username": "nino",
+				"name": map[string]interface{}{
+					"firstName": "Nino",
+					"lastName":  "Naan",
+				},
+			}
+
+			expected := bson.M{"$set": bson.M{"norm": map[string]interface{}{
+				"username": "nino",
+				"name":     map[string]interface{}{"firstName": "Nino"},
+			}}}
+			Expect(BuildRefetchQuery(w, document)).To(Equal(expected))
+		})
+
+		It("will detect updates of tracked fields", func() {
+			Expect(TouchesTrackedFields(w, map[string]interface{}{
+				"$inc": map[string]interface{}{"name.age": 1},
+			})).To(BeTrue())
+
+			Expect(TouchesTrackedFields(w, map[string]interface{}{
+				"$set": map[string]interface{}{"otherField": "A"},
+			})).To(BeFalse())
+
+			Expect(TouchesTrackedFields(w, map[string]interface{}{
+				"otherField": "A",
+			})).To(BeTrue())
+		})
+
+		It("will generate repair queries", func() {
+			drift := Drift{
+				Kind: DriftMismatch,
+				Fields: []FieldDrift{
+					{Field: "username", Target: "norm.username", Expected: "nino", Actual: "naan"},
+					{Field: "name", Target: "norm.name", Actual: "Naan", Missing: true},
+				},
+			}
+
+			expected := bson.M{
+				"$set":   bson.M{"norm.username": "nino"},
+				"$unset": bson.M{"norm.name": ""},
+			}
+			Expect(BuildRepairQuery(drift)).To(Equal(expected))
+		})
+
+		It("will return nil without tracked fields", func() {
+			command := map[string]interface{}{
+				"$set": map[string]interface{}{
+					"otherField": "A",
+				},
+			}
+
+			Expect(BuildUpdateQuery(w, command)).To(BeNil())
+		})
+
+		Context("with overlapping tracked fields", func() {
+			BeforeEach(func() {
+				w.TrackFields = []string{"username", "profile", "profile.avatar"}
+			})
+
+			document := map[string]interface{}{
+				"username": "nino",
+				"profile":  map[string]interface{}{"avatar": "nino.png", "bio": "hello"},
+			}
+
+			It("will copy children only along with their parent", func() {
+				expected := bson.M{"$set": bson.M{
+					"norm.username": "nino",
+					"norm.profile":  map[string]interface{}{"avatar": "nino.png", "bio": "hello"},
+				}}
+				Expect(BuildInsertQuery(w, document)).To(Equal(expected))
+			})
+
+			It("will replace children only along with their parent", func() {
+				expected := bson.M{"$set": bson.M{
+					"norm.username": "nino",
+					"norm.profile":  map[string]interface{}{"avatar": "nino.png", "bio": "hello"},
+				}}
+				Expect(BuildReplaceQuery(w, document)).To(Equal(expected))
+			})
+
+			It("will translate updates of the parent without a resync", func() {
+				command := map[string]interface{}{
+					"$set": map[string]interface{}{"profile": map[string]interface{}{"avatar": "new.png"}},
+				}
+
+				Expect(RequiresResync(w, command)).To(BeFalse())
+				Expect(BuildUpdateQuery(w, command)).To(Equal(bson.M{"$set": bson.M{
+					"norm.profile": map[string]interface{}{"avatar": "new.png"},
+				}}))
+			})
+
+			It("will resync updates of the parent if a child is renamed", func() {
+				w.FieldMapping = map[string]string{"profile.avatar": "avatarUrl"}
+				command := map[string]interface{}{
+					"$set": map[string]interface{}{"profile": map[string]interface{}{"avatar": "new.png"}},
+				}
+
+				Expect(RequiresResync(w, command)).To(BeTrue())
+			})
+		})
+
+		Context("with wildcards and excluded fields", func() {
+			BeforeEach(func() {
+				w.TrackFields = []string{"*"}
+				w.ExcludeFields = []string{"passwordHash", "profile.secret"}
+			})
+
+			document := map[string]interface{}{
+				"_id":          "56a65494b204ccd1edc0b055",
+				"username":     "nino",
+				"passwordHash": "hash",
+				"profile":      map[string]interface{}{"avatar": "nino.png", "secret": "psst"},
+			}
+
+			It("will copy all fields except excluded ones", func() {
+				expected := bson.M{"$set": bson.M{
+					"norm.username": "nino",
+					"norm.profile":  map[string]interface{}{"avatar": "nino.png"},
+				}}
+				Expect(BuildInsertQuery(w, document)).To(Equal(expected))
+			})
+
+			It("will never update excluded fields", func() {
+				command := map[string]interface{}{
+					"$set": map[string]interface{}{
+						"passwordHash": "new",
+						"profile":      map[string]interface{}{"avatar": "new.png", "secret": "psst"},
+						"nickname":     "nin",
+					},
+					"$unset": map[string]interface{}{"profile.secret": ""},
+				}
+
+				expected := bson.M{"$set": bson.M{
+					"norm.profile":  map[string]interface{}{"avatar": "new.png"},
+					"norm.nickname": "nin",
+				}}
+				Expect(BuildUpdateQuery(w, command)).To(Equal(expected))
+			})
+
+			It("will rewrite the whole normalized field on replacements", func() {
+				expected := bson.M{"$set": bson.M{"norm": map[string]interface{}{
+					"username": "nino",
+					"profile":  map[string]interface{}{"avatar": "nino.png"},
+				}}}
+				Expect(BuildReplaceQuery(w, document)).To(Equal(expected))
+			})
+
+			It("will copy whole subdocuments with profile.*", func() {
+				w.TrackFields = []string{"profile.*"}
+				command := map[string]interface{}{
+					"$set": map[string]interface{}{"profile.banner": "banner.png"},
+				}
+
+				Expect(BuildUpdateQuery(w, command)).To(Equal(bson.M{"$set": bson.M{"norm.profile.banner": "banner.png"}}))
+				Expect(BuildInsertQuery(w, document)).To(Equal(bson.M{"$set": bson.M{
+					"norm.profile": map[string]interface{}{"avatar": "nino.png"},
+				}}))
+			})
+		})
+
+		Context("with transforms", func() {
+			BeforeEach(func() {
+				w.TrackFields = []string{"username"}
+				w.Transforms = map[string]string{
+					"displayName": `{{.name.firstName}} {{.name.lastName}}`,
+					"login":       `{{lower .username}}`,
+				}
+			})
+
+			document := map[string]interface{}{
+				"username": "Nino",
+				"name":     map[string]interface{}{"firstName": "Nino", "lastName": "Naan"},
+			}
+
+			It("will store computed fields on insert", func() {
+				expected := bson.M{"$set": bson.M{
+					"norm.username":    "Nino",
+					"norm.displayName": "Nino Naan",
+					"norm.login":       "nino",
+				}}
+				Expect(BuildInsertQuery(w, document)).To(Equal(expected))
+			})
+
+			It("will render missing fields as empty", func() {
+				expected := bson.M{"$set": bson.M{
+					"norm.username":    "Nino",
+					"norm.displayName": " ",
+					"norm.login":       "nino",
+				}}
+				Expect(BuildReplaceQuery(w, map[string]interface{}{"username": "Nino"})).To(Equal(expected))
+			})
+
+			It("will detect changes of fields read by transforms", func() {
+				command := map[string]interface{}{
+					"$set": map[string]interface{}{"name.lastName": "Waana"},
+				}
+
+				Expect(TouchesTrackedFields(w, command)).To(BeTrue())
+				Expect(TouchesTrackedFields(w, map[string]interface{}{
+					"$set": map[string]interface{}{"email": "nino@example.com"},
+				})).To(BeFalse())
+			})
+		})
+
+		Context("with a field mapping", func() {
+			BeforeEach(func() {
+				w.TrackFields = []string{"username", "profile.avatar"}
+				w.FieldMapping = map[string]string{"username": "authorName", "profile.avatar": "avatarUrl"}
+			})
+
+			It("will rename inserted fields", func() {
+				document := map[string]interface{}{
+					"username": "nino",
+					"profile":  map[string]interface{}{"avatar": "nino.png", "bio": "hidden"},
+				}
+
+				expected := bson.M{"$set": bson.M{"norm.authorName": "nino", "norm.avatarUrl": "nino.png"}}
+				Expect(BuildInsertQuery(w, document)).To(Equal(expected))
+			})
+
+			It("will rename updated fields and their children", func() {
+				command := map[string]interface{}{
+					"$set":   map[string]interface{}{"profile.avatar.small": "small.png"},
+					"$unset": map[string]interface{}{"username": ""},
+				}
+
+				expected := bson.M{
+					"$set":   bson.M{"norm.avatarUrl.small": "small.png"},
+					"$unset": bson.M{"norm.authorName": ""},
+				}
+				Expect(BuildUpdateQuery(w, command)).To(Equal(expected))
+			})
+
+			It("will update renamed fields inside of their tracked parent as well", func() {
+				w.TrackFields = []string{"profile", "profile.avatar"}
+				w.FieldMapping = map[string]string{"profile.avatar": "avatarUrl"}
+
+				document := map[string]interface{}{
+					"profile": map[string]interface{}{"avatar": "nino.png"},
+				}
+
+				Expect(BuildInsertQuery(w, document)).To(Equal(bson.M{"$set": bson.M{
+					"norm.profile":   map[string]interface{}{"avatar": "nino.png"},
+					"norm.avatarUrl": "nino.png",
+				}}))
+
+				command := map[string]interface{}{
+					"$set": map[string]interface{}{"profile.avatar": "new.png"},
+				}
+
+				Expect(RequiresResync(w, command)).To(BeFalse())
+				Expect(BuildUpdateQuery(w, command)).To(Equal(bson.M{"$set": bson.M{
+					"norm.avatarUrl":      "new.png",
+					"norm.profile.avatar": "new.png",
+				}}))
+
+				Expect(RequiresResync(w, map[string]interface{}{
+					"$rename": map[string]interface{}{"profile.avatar": "profile.image"},
+				})).To(BeTrue())
+			})
+
+			It("will rename refetched fields", func() {
+				document := map[string]interface{}{
+					"username": "nino",
+					"profile":  map[string]interface{}{"avatar": "nino.png"},
+				}
+
+				expected := bson.M{"$set": bson.M{"norm": map[string]interface{}{
+					"authorName": "nino",
+					"avatarUrl":  "nino.png",
+				}}}
+				Expect(BuildRefetchQuery(w, document)).To(Equal(expected))
+			})
+		})
 	})
 })
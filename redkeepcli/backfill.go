@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/manyminds/redkeep"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//backfill denormalizes existing documents of one or all watches
+//the last processed id of every watch is stored in the resume file,
+//so an interrupted backfill continues where it stopped
+func backfill(args []string) {
+	flags := flag.NewFlagSet("redkeepcli backfill", flag.ExitOnError)
+	configurationFilepath := flags.String("config", "configuration.json", "path to the configuration file")
+	watch := flags.Int("watch", -1, "index of the watch to backfill, all watches if negative")
+	batchSize := flags.Int("batch", 500, "number of documents updated at once")
+	resumeFile := flags.String("resume-file", "", "file to store the progress in, an existing file resumes the backfill")
+	flags.Parse(args)
+
+	config := loadConfiguration(*configurationFilepath)
+	if *watch >= len(config.Watches) {
+		log.Fatalf("There is no watch with index %d.\n", *watch)
+	}
+
+	session, err := mgo.Dial(config.Mongo.ConnectionURI)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer session.Close()
+	session.SetMode(mgo.Strong, true)
+
+	state := loadResumeState(*resumeFile)
+	for i, w := range config.Watches {
+		if *watch >= 0 && i != *watch {
+			continue
+		}
+
+		key := strconv.Itoa(i)
+		options := redkeep.BackfillOptions{
+			BatchSize: *batchSize,
+			Progress: func(p redkeep.BackfillProgress) {
+				log.Printf("Watch %d (%s): %d/%d processed, %d updated.\n", i, w.TargetCollection, p.Processed, p.Total, p.Updated)
+				if id, ok := p.LastID.(bson.ObjectId); ok {
+					state[key] = id.Hex()
+					saveResumeState(*resumeFile, state)
+				}
+			},
+		}
+
+		if lastID, ok := state[key]; ok && bson.IsObjectIdHex(lastID) {
+			log.Printf("Resuming watch %d after %s.\n", i, lastID)
+			options.StartAfter = bson.ObjectIdHex(lastID)
+		}
+
+		if err := redkeep.Backfill(session, w, options); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	log.Println("Backfill finished.")
+}
+
+//loadResumeState reads the last processed id per watch index
+func loadResumeState(path string) map[string]string {
+	state := map[string]string{}
+	if path == "" {
+		return state
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Fatal(err)
+	}
+
+	return state
+}
+
+func saveResumeState(path string, state map[string]string) {
+	if path == "" {
+		return
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/manyminds/redkeep"
+	"gopkg.in/mgo.v2"
+)
+
+//recompute rebuilds the summaries and aggregates of one or all watches,
+//it repairs drifted counters without touching watches of kind copy
+func recompute(args []string) {
+	flags := flag.NewFlagSet("redkeepcli recompute", flag.ExitOnError)
+	configurationFilepath := flags.String("config", "configuration.json", "path to the configuration file")
+	watch := flags.Int("watch", -1, "index of the watch to recompute, all summary and aggregate watches if negative")
+	batchSize := flags.Int("batch", 500, "number of documents updated at once")
+	flags.Parse(args)
+
+	config := loadConfiguration(*configurationFilepath)
+	if *watch >= len(config.Watches) {
+		log.Fatalf("There is no watch with index %d.\n", *watch)
+	}
+
+	session, err := mgo.Dial(config.Mongo.ConnectionURI)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer session.Close()
+	session.SetMode(mgo.Strong, true)
+
+	for i, w := range config.Watches {
+		if *watch >= 0 && i != *watch {
+			continue
+		}
+
+		if w.Kind != redkeep.WatchKindSummary && w.Kind != redkeep.WatchKindAggregate {
+			if *watch >= 0 {
+				log.Fatalf("Watch %d is neither a summary nor an aggregate.\n", i)
+			}
+
+			continue
+		}
+
+		options := redkeep.BackfillOptions{
+			BatchSize: *batchSize,
+			Progress: func(p redkeep.BackfillProgress) {
+				log.Printf("Watch %d (%s): %d/%d recomputed.\n", i, w.TargetCollection, p.Processed, p.Total)
+			},
+		}
+
+		if err := redkeep.Backfill(session, w, options); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	log.Println("Recompute finished.")
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/manyminds/redkeep"
+	"gopkg.in/mgo.v2"
+)
+
+//repair rewrites all normalized fields that drifted from their sources
+func repair(args []string) {
+	flags := flag.NewFlagSet("redkeepcli repair", flag.ExitOnError)
+	configurationFilepath := flags.String("config", "configuration.json", "path to the configuration file")
+	watch := flags.Int("watch", -1, "index of the watch to repair, all watches if negative")
+	dryRun := flags.Bool("dry-run", false, "only print what would be repaired")
+	batchSize := flags.Int("batch", 500, "number of documents verified and written at once")
+	rateLimit := flags.Int("rate", 0, "maximum number of documents written per second, 0 is unlimited")
+	flags.Parse(args)
+
+	config := loadConfiguration(*configurationFilepath)
+	if *watch >= len(config.Watches) {
+		log.Fatalf("There is no watch with index %d.\n", *watch)
+	}
+
+	session, err := mgo.Dial(config.Mongo.ConnectionURI)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer session.Close()
+	session.SetMode(mgo.Strong, true)
+
+	encoder := json.NewEncoder(os.Stdout)
+	for i, w := range config.Watches {
+		if *watch >= 0 && i != *watch {
+			continue
+		}
+
+		report, err := redkeep.Repair(session, w, redkeep.RepairOptions{
+			DryRun:    *dryRun,
+			BatchSize: *batchSize,
+			RateLimit: *rateLimit,
+			Report: func(d redkeep.Drift) {
+				err := encoder.Encode(struct {
+					Watch int `json:"watch"`
+					redkeep.Drift
+				}{Watch: i, Drift: d})
+
+				if err != nil {
+					log.Fatal(err)
+				}
+			},
+		})
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf(
+			"Watch %d (%s): %d checked, %d mismatches, %d repaired, %d missing references, %d dangling references.\n",
+			i, w.TargetCollection, report.Checked, report.Mismatches, report.Repaired, report.MissingReferences, report.DanglingReferences,
+		)
+	}
+}
@@ -1,37 +1,86 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"io/ioutil"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/manyminds/redkeep"
 )
 
 func main() {
-	configurationFilepath := flag.String("config", "configuration.json", "path to the configuration file")
-	rescan := flag.Bool("rescan", false, "shall we start from the oplog beginnging?")
-	flag.Parse()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "backfill":
+			backfill(os.Args[2:])
+			return
+		case "verify":
+			verify(os.Args[2:])
+			return
+		case "repair":
+			repair(os.Args[2:])
+			return
+		case "recompute":
+			recompute(os.Args[2:])
+			return
+		}
+	}
+
+	tail(os.Args[1:])
+}
 
-	if configurationFilepath == nil {
-		return
+func tail(args []string) {
+	flags := flag.NewFlagSet("redkeepcli", flag.ExitOnError)
+	configurationFilepath := flags.String("config", "configuration.json", "path to the configuration file")
+	rescan := flags.Bool("rescan", false, "shall we start from the oplog beginnging?")
+	dryRun := flags.Bool("dry-run", false, "only print the queries instead of executing them")
+	dryRunOutput := flags.String("dry-run-output", "", "file to write the dry run queries to, stdout if empty")
+	flags.Parse(args)
+
+	config := loadConfiguration(*configurationFilepath)
+	config.Agent.ForceRescan = config.Agent.ForceRescan || *rescan
+	config.Agent.DryRun = config.Agent.DryRun || *dryRun
+	if *dryRunOutput != "" {
+		config.Agent.DryRunOutput = *dryRunOutput
 	}
 
-	file, err := ioutil.ReadFile(*configurationFilepath)
+	agent, err := redkeep.NewTailAgent(*config)
 	if err != nil {
 		log.Fatal(err)
 	}
-	config, err := redkeep.NewConfiguration(file)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Println("Stopping agent.")
+		cancel()
+	}()
+
+	log.Println("Agent started.")
+	err = agent.Run(ctx)
+	agent.Close()
 	if err != nil {
 		log.Fatal(err)
 	}
-	running := make(chan bool)
-	agent, err := redkeep.NewTailAgent(*config)
+}
+
+//loadConfiguration reads and validates the configuration file
+func loadConfiguration(path string) *redkeep.Configuration {
+	file, err := ioutil.ReadFile(path)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	log.Println("Agent started.")
-	agent.Tail(running, *rescan)
-	running <- false
+	config, err := redkeep.NewConfiguration(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return config
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	"github.com/manyminds/redkeep"
+	"gopkg.in/mgo.v2"
+)
+
+//verify reports all target documents whose normalized fields
+//drifted from their sources as JSON lines
+func verify(args []string) {
+	flags := flag.NewFlagSet("redkeepcli verify", flag.ExitOnError)
+	configurationFilepath := flags.String("config", "configuration.json", "path to the configuration file")
+	watch := flags.Int("watch", -1, "index of the watch to verify, all watches if negative")
+	output := flags.String("output", "", "file to write the JSON lines to, stdout if empty")
+	flags.Parse(args)
+
+	config := loadConfiguration(*configurationFilepath)
+	if *watch >= len(config.Watches) {
+		log.Fatalf("There is no watch with index %d.\n", *watch)
+	}
+
+	var writer io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		writer = file
+	}
+
+	session, err := mgo.Dial(config.Mongo.ConnectionURI)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer session.Close()
+	session.SetMode(mgo.Strong, true)
+
+	encoder := json.NewEncoder(writer)
+	drifted := false
+	for i, w := range config.Watches {
+		if *watch >= 0 && i != *watch {
+			continue
+		}
+
+		report, err := redkeep.Verify(session, w, func(d redkeep.Drift) {
+			drifted = true
+			err := encoder.Encode(struct {
+				Watch int `json:"watch"`
+				redkeep.Drift
+			}{Watch: i, Drift: d})
+
+			if err != nil {
+				log.Fatal(err)
+			}
+		})
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf(
+			"Watch %d (%s): %d checked, %d mismatches, %d missing references, %d dangling references.\n",
+			i, w.TargetCollection, report.Checked, report.Mismatches, report.MissingReferences, report.DanglingReferences,
+		)
+	}
+
+	if drifted {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,352 @@
+package redkeep
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//all supported ReferenceTypes of a watch
+const (
+	//ReferenceDBRef references are DBRefs (default)
+	ReferenceDBRef = "dbref"
+	//ReferenceObjectID references are the ObjectId of the tracked document
+	ReferenceObjectID = "objectId"
+	//ReferenceString references are the hex string of the ObjectId of the tracked document
+	ReferenceString = "string"
+	//ReferenceScalar references are matched against ReferenceField of the tracked document
+	ReferenceScalar = "scalar"
+)
+
+//sourceRef identifies the tracked document a target references
+type sourceRef struct {
+	Namespace string
+	Field     string
+	Value     interface{}
+}
+
+func (s sourceRef) selector() bson.M {
+	return bson.M{s.Field: s.Value}
+}
+
+//referenceType returns the ReferenceType of w with the default applied
+func referenceType(w Watch) string {
+	if w.ReferenceType == "" {
+		return ReferenceDBRef
+	}
+
+	return w.ReferenceType
+}
+
+//referenceField returns the ReferenceField of w with the default applied
+func referenceField(w Watch) string {
+	if w.ReferenceField == "" {
+		return "_id"
+	}
+
+	return w.ReferenceField
+}
+
+//getSourceRef interprets value as reference of the type configured in w
+//targetDB is used for DBRefs without database
+func getSourceRef(w Watch, value interface{}, targetDB string) (sourceRef, bool) {
+	switch referenceType(w) {
+	case ReferenceDBRef:
+		ref, ok := getReference(value, targetDB)
+		return sourceRef{Namespace: ref.Database + "." + ref.Collection, Field: "_id", Value: ref.Id}, ok
+	case ReferenceObjectID:
+		id, ok := value.(bson.ObjectId)
+		return sourceRef{Namespace: w.TrackCollection, Field: "_id", Value: id}, ok
+	case ReferenceString:
+		id, ok := value.(string)
+		if !ok || !bson.IsObjectIdHex(id) {
+			return sourceRef{}, false
+		}
+
+		return sourceRef{Namespace: w.TrackCollection, Field: "_id", Value: bson.ObjectIdHex(id)}, true
+	case ReferenceScalar:
+		return sourceRef{Namespace: w.TrackCollection, Field: referenceField(w), Value: value}, value != nil
+	}
+
+	return sourceRef{}, false
+}
+
+//targetReference returns the value targets use to reference the tracked
+//document with the given id. Scalar references to other fields than _id
+//need the tracked document, it is loaded with session. Targets of
+//chains are selected by all ids of the first hop that reach it.
+func targetReference(session *mgo.Session, w Watch, id interface{}) (interface{}, bool, error) {
+	if len(w.Via) > 0 {
+		return viaReference(session, w, id)
+	}
+
+	switch referenceType(w) {
+	case ReferenceDBRef, ReferenceObjectID:
+		return id, true, nil
+	case ReferenceString:
+		objectID, ok := id.(bson.ObjectId)
+		return objectID.Hex(), ok, nil
+	case ReferenceScalar:
+		field := referenceField(w)
+		if field == "_id" {
+			return id, true, nil
+		}
+
+		source, ok, err := loadSource(session, w, id)
+		if err != nil || !ok {
+			return nil, false, err
+		}
+
+		value, ok := lookupValue(field, source)
+		return value, ok, nil
+	}
+
+	return nil, false, nil
+}
+
+//embeddedPath splits a TriggerReference like answers.$[].author into
+//the array of subdocuments and the path of the reference inside of them
+func embeddedPath(triggerReference string) (array, field string, ok bool) {
+	parts := strings.Split(triggerReference, ".$[].")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+//referencePath returns the path that matches
+//the references of w in queries
+func referencePath(w Watch) string {
+	return strings.Replace(w.TriggerReference, ".$[]", "", 1)
+}
+
+//targetSelector returns the selector of all targets that contain
+//reference, for arrays it matches every element
+func targetSelector(w Watch, reference interface{}) bson.M {
+	if referenceType(w) == ReferenceDBRef {
+		return bson.M{referencePath(w) + ".$id": reference}
+	}
+
+	return bson.M{referencePath(w): reference}
+}
+
+//matchesReference returns true if value is a reference of the type
+//configured in w that equals reference (see targetReference)
+func matchesReference(w Watch, value, reference interface{}) bool {
+	if referenceType(w) == ReferenceDBRef {
+		ref, ok := getReference(value, "")
+		if !ok {
+			return false
+		}
+
+		value = ref.Id
+	}
+
+	return reflect.DeepEqual(value, reference)
+}
+
+//keyReplacer removes characters that are not allowed in field names
+var keyReplacer = strings.NewReplacer(".", "_", "$", "_")
+
+//referenceKey returns the key of one reference inside the
+//normalized field of watches with ReferenceArray
+func referenceKey(reference interface{}) string {
+	if id, ok := reference.(bson.ObjectId); ok {
+		return id.Hex()
+	}
+
+	return keyReplacer.Replace(fmt.Sprint(reference))
+}
+
+//documentReference is one reference inside of a target, index is
+//the position in the array of subdocuments for embedded references
+//and -1 otherwise
+type documentReference struct {
+	value interface{}
+	index int
+}
+
+//documentReferences returns all references inside of document
+func documentReferences(w Watch, document map[string]interface{}) []documentReference {
+	var result []documentReference
+
+	array, field, embedded := embeddedPath(w.TriggerReference)
+	if !embedded {
+		for _, value := range referenceValues(w, GetValue(w.TriggerReference, document)) {
+			result = append(result, documentReference{value: value, index: -1})
+		}
+
+		return result
+	}
+
+	elements, _ := GetValue(array, document).([]interface{})
+	for i, element := range elements {
+		if value := GetValue(field, element); value != nil {
+			result = append(result, documentReference{value: value, index: i})
+		}
+	}
+
+	return result
+}
+
+//normalizedWatch returns w with the full paths of one reference,
+//TargetNormalizedField is where the tracked fields of reference are
+//stored and TriggerReference the path of the reference itself.
+//index is the position in the array of subdocuments (see documentReference).
+func normalizedWatch(w Watch, reference interface{}, index int) Watch {
+	if array, field, ok := embeddedPath(w.TriggerReference); ok && index >= 0 {
+		w.TargetNormalizedField = fmt.Sprintf("%s.%d.%s", array, index, w.TargetNormalizedField)
+		w.TriggerReference = fmt.Sprintf("%s.%d.%s", array, index, field)
+	}
+
+	if w.ReferenceArray {
+		w.TargetNormalizedField = w.TargetNormalizedField + "." + referenceKey(reference)
+		//only valid together with targetSelector
+		w.TriggerReference = w.TriggerReference + ".$"
+	}
+
+	return w
+}
+
+//referenceValues returns all references of value, which
+//is an array of references if w has ReferenceArray
+func referenceValues(w Watch, value interface{}) []interface{} {
+	if value == nil {
+		return nil
+	}
+
+	if !w.ReferenceArray {
+		return []interface{}{value}
+	}
+
+	values, _ := value.([]interface{})
+	return values
+}
+
+//touchesEmbeddedArray returns true if command might add or change a
+//reference inside of the array of subdocuments of w. Changes of the
+//normalized fields inside of that array do not count.
+func touchesEmbeddedArray(w Watch, command map[string]interface{}) bool {
+	array, field, ok := embeddedPath(w.TriggerReference)
+	if !ok {
+		return false
+	}
+
+	for _, query := range command {
+		fields, ok := query.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		for key := range fields {
+			if key == array {
+				return true
+			}
+
+			if !strings.HasPrefix(key, array+".") {
+				continue
+			}
+
+			rest := strings.SplitN(key[len(array)+1:], ".", 2)
+			if _, err := strconv.Atoi(rest[0]); err != nil {
+				continue
+			}
+
+			if len(rest) == 1 || rest[1] == field || strings.HasPrefix(rest[1], field+".") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//staleEntries returns the paths of all entries inside of the normalized
+//field of an array of references whose reference is not in references
+//anymore. normalized is the current value of TargetNormalizedField.
+func staleEntries(w Watch, targetDB string, normalized interface{}, references []documentReference) []string {
+	entries, ok := normalized.(map[string]interface{})
+	if !w.ReferenceArray || !ok {
+		return nil
+	}
+
+	current := map[string]bool{}
+	for _, r := range references {
+		if ref, ok := getSourceRef(w, r.value, targetDB); ok {
+			current[referenceKey(ref.Value)] = true
+		}
+	}
+
+	var result []string
+	for key := range entries {
+		if !current[key] {
+			result = append(result, w.TargetNormalizedField+"."+key)
+		}
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+//isArrayElement returns true if key is one element of array, like participants.3
+func isArrayElement(array, key string) bool {
+	if !strings.HasPrefix(key, array+".") {
+		return false
+	}
+
+	_, err := strconv.Atoi(key[len(array)+1:])
+	return err == nil
+}
+
+//insertedReferences returns all references a new or updated target
+//contains, for arrays of references also $push and $addToSet are read.
+//The oplog records both as $set of the new positions, like participants.3.
+//Embedded references are only found in complete documents.
+func insertedReferences(w Watch, command map[string]interface{}) []documentReference {
+	if _, _, embedded := embeddedPath(w.TriggerReference); embedded || isReplacement(command) {
+		return documentReferences(w, command)
+	}
+
+	var values []interface{}
+	if value := GetValue("$set."+w.TriggerReference, command); value != nil {
+		values = referenceValues(w, value)
+	} else if w.ReferenceArray {
+		fields, _ := command["$set"].(map[string]interface{})
+		for key, value := range fields {
+			if isArrayElement(w.TriggerReference, key) {
+				values = append(values, value)
+			}
+		}
+
+		for _, operator := range []string{"$push", "$addToSet"} {
+			fields, ok := command[operator].(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			value, ok := fields[w.TriggerReference]
+			if !ok {
+				continue
+			}
+
+			if each, ok := GetValue("$each", value).([]interface{}); ok {
+				values = append(values, each...)
+			} else {
+				values = append(values, value)
+			}
+		}
+	}
+
+	var result []documentReference
+	for _, value := range values {
+		result = append(result, documentReference{value: value, index: -1})
+	}
+
+	return result
+}
@@ -0,0 +1,111 @@
+package redkeep
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//RepairOptions tune a repair
+//DryRun only reports what would be repaired, BatchSize is the number
+//of targets verified at once (default 500), RateLimit the maximum
+//number of targets written per second (0 is unlimited), a batch is
+//then written in chunks of at most RateLimit targets.
+//Report, if set, is called for every target that drifted.
+type RepairOptions struct {
+	DryRun    bool
+	BatchSize int
+	RateLimit int
+	Report    func(Drift)
+}
+
+//RepairReport summarizes the result of Repair
+type RepairReport struct {
+	VerifyReport
+	Repaired int `json:"repaired"`
+}
+
+//Repair verifies all targets of w like Verify does and rewrites
+//the mismatched normalized fields. Missing and dangling references
+//can not be repaired, they are only reported.
+func Repair(session *mgo.Session, w Watch, options RepairOptions) (RepairReport, error) {
+	batchSize := options.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+
+	session = session.Copy()
+	defer session.Close()
+	collection := getCollection(session, w.TargetCollection)
+
+	var result RepairReport
+	verifyReport, err := verifyWatch(session, w, batchSize, func(drifts []Drift) error {
+		var repairs []Drift
+		for _, d := range drifts {
+			if options.Report != nil {
+				options.Report(d)
+			}
+
+			if d.Kind == DriftMismatch {
+				repairs = append(repairs, d)
+			}
+		}
+
+		if options.DryRun {
+			return nil
+		}
+
+		//with a rate limit, at most RateLimit targets are written at
+		//once and every chunk takes at least its share of a second
+		chunkSize := len(repairs)
+		if options.RateLimit > 0 {
+			chunkSize = options.RateLimit
+		}
+
+		for len(repairs) > 0 {
+			chunk := repairs
+			if len(chunk) > chunkSize {
+				chunk = repairs[:chunkSize]
+			}
+			repairs = repairs[len(chunk):]
+
+			bulk := collection.Bulk()
+			bulk.Unordered()
+			for _, d := range chunk {
+				bulk.Update(bson.M{"_id": d.ID}, BuildRepairQuery(d))
+			}
+
+			started := time.Now()
+			if _, err := bulk.Run(); err != nil {
+				return err
+			}
+
+			result.Repaired += len(chunk)
+			if options.RateLimit > 0 {
+				minimum := time.Duration(len(chunk)) * time.Second / time.Duration(options.RateLimit)
+				time.Sleep(minimum - time.Since(started))
+			}
+		}
+
+		return nil
+	})
+
+	result.VerifyReport = verifyReport
+	return result, err
+}
+
+//BuildRepairQuery generates the query that rewrites all fields of a
+//mismatch, fields that are missing in the source will be removed
+func BuildRepairQuery(d Drift) bson.M {
+	result := bson.M{}
+	for _, f := range d.Fields {
+		if f.Missing {
+			addToQuery(result, "$unset", f.Target, "")
+		} else {
+			addToQuery(result, "$set", f.Target, f.Expected)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,205 @@
+package redkeep
+
+import (
+	"reflect"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//scanTargets calls handle with batches of all documents matching
+//selector ordered by _id, starting after the id startAfter if set
+func scanTargets(
+	collection *mgo.Collection,
+	selector bson.M,
+	startAfter interface{},
+	batchSize int,
+	handle func([]map[string]interface{}) error,
+) error {
+	iter := collection.Find(withStartAfter(selector, startAfter)).Sort("_id").Batch(batchSize).Iter()
+
+	for {
+		batch := make([]map[string]interface{}, 0, batchSize)
+		target := map[string]interface{}{}
+		for len(batch) < batchSize && iter.Next(&target) {
+			batch = append(batch, target)
+			target = map[string]interface{}{}
+		}
+
+		if len(batch) == 0 {
+			break
+		}
+
+		if err := handle(batch); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+
+	return iter.Close()
+}
+
+//countTargets counts all documents scanTargets would visit
+func countTargets(collection *mgo.Collection, selector bson.M, startAfter interface{}) (int, error) {
+	return collection.Find(withStartAfter(selector, startAfter)).Count()
+}
+
+func withStartAfter(selector bson.M, startAfter interface{}) bson.M {
+	if startAfter == nil {
+		return selector
+	}
+
+	result := bson.M{"_id": bson.M{"$gt": startAfter}}
+	for k, v := range selector {
+		result[k] = v
+	}
+
+	return result
+}
+
+//sourceCache loads every referenced document only once
+type sourceCache struct {
+	session *mgo.Session
+	sources map[sourceKey]map[string]interface{}
+}
+
+//sourceKey is the hashable form of a sourceRef, scalar
+//references might be arrays or subdocuments
+type sourceKey struct {
+	namespace string
+	field     string
+	value     string
+}
+
+func newSourceCache(session *mgo.Session) *sourceCache {
+	return &sourceCache{session: session, sources: map[sourceKey]map[string]interface{}{}}
+}
+
+//cacheKey returns the key of ref, values that can not be
+//marshalled are not cached
+func cacheKey(ref sourceRef) (sourceKey, bool) {
+	value, err := bson.Marshal(bson.M{"v": ref.Value})
+	if err != nil {
+		return sourceKey{}, false
+	}
+
+	return sourceKey{namespace: ref.Namespace, field: ref.Field, value: string(value)}, true
+}
+
+//load returns the referenced document, or nil if it does not exist
+func (s *sourceCache) load(ref sourceRef) (map[string]interface{}, error) {
+	key, cacheable := cacheKey(ref)
+	if source, ok := s.sources[key]; ok && cacheable {
+		return source, nil
+	}
+
+	source := map[string]interface{}{}
+	err := getCollection(s.session, ref.Namespace).Find(ref.selector()).One(&source)
+	if err == mgo.ErrNotFound {
+		source = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if cacheable {
+		s.sources[key] = source
+	}
+
+	return source, nil
+}
+
+//computeFunc computes the value of the normalized field of one
+//referenced document, ok is false if it can not be computed
+type computeFunc func(parent map[string]interface{}) (value interface{}, ok bool, err error)
+
+//backfillComputed rewrites the normalized field of all documents
+//in the target collection of w with the value compute returns
+func backfillComputed(session *mgo.Session, w Watch, options BackfillOptions, batchSize int, compute computeFunc) error {
+	collection := getCollection(session, w.TargetCollection)
+
+	total, err := countTargets(collection, bson.M{}, options.StartAfter)
+	if err != nil {
+		return err
+	}
+
+	progress := BackfillProgress{Total: total, LastID: options.StartAfter}
+	return scanTargets(collection, bson.M{}, options.StartAfter, batchSize, func(batch []map[string]interface{}) error {
+		bulk := collection.Bulk()
+		bulk.Unordered()
+
+		updated := 0
+		for _, parent := range batch {
+			value, ok, err := compute(parent)
+			if err != nil {
+				return err
+			}
+
+			if !ok {
+				continue
+			}
+
+			bulk.Update(bson.M{"_id": parent["_id"]}, bson.M{"$set": bson.M{w.TargetNormalizedField: value}})
+			updated++
+		}
+
+		if updated > 0 {
+			if _, err := bulk.Run(); err != nil {
+				return err
+			}
+		}
+
+		progress.Processed += len(batch)
+		progress.Updated += updated
+		progress.LastID = batch[len(batch)-1]["_id"]
+		if options.Progress != nil {
+			options.Progress(progress)
+		}
+
+		return nil
+	})
+}
+
+//verifyComputed compares the normalized field of all documents in the
+//target collection of w with the value compute returns, every
+//difference is a mismatch
+func verifyComputed(session *mgo.Session, w Watch, batchSize int, handle func([]Drift) error, compute computeFunc) (VerifyReport, error) {
+	collection := getCollection(session, w.TargetCollection)
+
+	var result VerifyReport
+	err := scanTargets(collection, bson.M{}, nil, batchSize, func(batch []map[string]interface{}) error {
+		var drifts []Drift
+		for _, parent := range batch {
+			expected, ok, err := compute(parent)
+			if err != nil {
+				return err
+			}
+
+			result.Checked++
+			if !ok {
+				continue
+			}
+
+			actual, ok := lookupValue(w.TargetNormalizedField, parent)
+			if ok && reflect.DeepEqual(actual, expected) {
+				continue
+			}
+
+			result.Mismatches++
+			drifts = append(drifts, Drift{
+				Kind:       DriftMismatch,
+				Collection: w.TargetCollection,
+				ID:         parent["_id"],
+				Fields: []FieldDrift{{
+					Field:    w.TargetNormalizedField,
+					Target:   w.TargetNormalizedField,
+					Expected: expected,
+					Actual:   actual,
+				}},
+			})
+		}
+
+		return handle(drifts)
+	})
+
+	return result, err
+}
@@ -0,0 +1,200 @@
+package redkeep
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//all kinds of watches
+const (
+	//WatchKindCopy copies fields of the tracked document into all documents that reference it (default)
+	WatchKindCopy = "copy"
+	//WatchKindSummary keeps summaries of the latest referencing documents in the referenced document
+	WatchKindSummary = "summary"
+)
+
+const (
+	defaultSummaryLimit  = 10
+	defaultSummarySortBy = "_id"
+)
+
+//ReverseTracker can handle changes of documents that are
+//summarized or aggregated in the documents they reference
+type ReverseTracker interface {
+	HandleChildChange(w Watch, id interface{}) error
+}
+
+//parentLockCount is the number of locks recomputes of parents are spread over
+const parentLockCount = 64
+
+//parentLocks serializes recomputes of the same parent. Children are
+//sharded by their own id, so children of one parent are handled by
+//different workers. Without the lock a slow worker could overwrite
+//a newer summary or aggregate with the one it computed before.
+type parentLocks [parentLockCount]sync.Mutex
+
+//lock locks the parent of namespace that is identified by key,
+//the returned func unlocks it again
+func (l *parentLocks) lock(namespace string, key interface{}) func() {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s/%v", namespace, key)
+
+	m := &l[h.Sum32()%parentLockCount]
+	m.Lock()
+	return m.Unlock
+}
+
+//isSummary returns true if w keeps summaries of its tracked documents
+func isSummary(w Watch) bool {
+	return w.Kind == WatchKindSummary
+}
+
+//parentWatch returns w with the referenced collection as tracked
+//collection, so references of children can be resolved with getSourceRef
+func parentWatch(w Watch) Watch {
+	w.TrackCollection = w.TargetCollection
+	return w
+}
+
+//parentReference returns the value children use to reference parent
+func parentReference(w Watch, parent map[string]interface{}) (interface{}, bool) {
+	switch referenceType(w) {
+	case ReferenceDBRef, ReferenceObjectID:
+		return parent["_id"], parent["_id"] != nil
+	case ReferenceString:
+		id, ok := parent["_id"].(bson.ObjectId)
+		return id.Hex(), ok
+	case ReferenceScalar:
+		return lookupValue(referenceField(w), parent)
+	}
+
+	return nil, false
+}
+
+//summaryEntry returns the summary of one child, it
+//contains its _id and all tracked fields and transforms
+func summaryEntry(w Watch, child map[string]interface{}) map[string]interface{} {
+	w.TargetNormalizedField = "entry"
+	entry, _ := BuildRefetchQuery(w, child)["$set"].(bson.M)["entry"].(map[string]interface{})
+	entry["_id"] = child["_id"]
+
+	return entry
+}
+
+//buildSummary loads the latest children of parent and returns their summaries
+func buildSummary(session *mgo.Session, w Watch, parent map[string]interface{}) ([]interface{}, error) {
+	reference, ok := parentReference(w, parent)
+	if !ok {
+		return []interface{}{}, nil
+	}
+
+	limit := w.Summary.Limit
+	if limit == 0 {
+		limit = defaultSummaryLimit
+	}
+
+	sortBy := w.Summary.SortBy
+	if sortBy == "" {
+		sortBy = defaultSummarySortBy
+	}
+
+	var children []map[string]interface{}
+	err := getCollection(session, w.TrackCollection).
+		Find(targetSelector(w, reference)).
+		Sort("-" + sortBy).
+		Limit(limit).
+		All(&children)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]interface{}, len(children))
+	for i, child := range children {
+		result[i] = summaryEntry(w, child)
+	}
+
+	return result, nil
+}
+
+//HandleChildChange recomputes the summaries of the current parent of the
+//child with the given id and of all parents that still contain it,
+//aggregated documents are passed to handleAggregateChange
+func (c changeTracker) HandleChildChange(w Watch, id interface{}) error {
+	if isAggregate(w) {
+		return c.handleAggregateChange(w, id)
+	}
+
+	session := c.session.Copy()
+	defer session.Close()
+
+	parents := getCollection(session, w.TargetCollection)
+
+	var selectors []bson.M
+	child := map[string]interface{}{}
+	err := getCollection(session, w.TrackCollection).FindId(id).One(&child)
+	if err == nil {
+		db := w.TargetCollection[:strings.Index(w.TargetCollection, ".")]
+		if ref, ok := getSourceRef(parentWatch(w), GetValue(w.TriggerReference, child), db); ok {
+			selectors = append(selectors, ref.selector())
+		}
+	} else if err != mgo.ErrNotFound {
+		return err
+	}
+
+	selectors = append(selectors, bson.M{w.TargetNormalizedField + "._id": id})
+
+	var parent map[string]interface{}
+	iter := parents.Find(bson.M{"$or": selectors}).Iter()
+	for iter.Next(&parent) {
+		if err := c.updateSummary(session, w, parent["_id"]); err != nil {
+			iter.Close()
+			return err
+		}
+
+		parent = nil
+	}
+
+	return iter.Close()
+}
+
+//updateSummary rebuilds the summary of the parent with the given id
+func (c changeTracker) updateSummary(session *mgo.Session, w Watch, id interface{}) error {
+	defer c.parents.lock(w.TargetCollection, id)()
+
+	//the parent is loaded again, it might have changed while waiting for the lock
+	parent := map[string]interface{}{}
+	err := getCollection(session, w.TargetCollection).FindId(id).One(&parent)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	summary, err := buildSummary(session, w, parent)
+	if err != nil {
+		return err
+	}
+
+	query := bson.M{"$set": bson.M{w.TargetNormalizedField: summary}}
+	err = c.writer.Update(w.TargetCollection, bson.M{"_id": id}, query)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+
+	return err
+}
+
+//computeSummary returns the summary of parent, it can always be computed
+func computeSummary(session *mgo.Session, w Watch) computeFunc {
+	return func(parent map[string]interface{}) (interface{}, bool, error) {
+		summary, err := buildSummary(session, w, parent)
+		return summary, err == nil, err
+	}
+}
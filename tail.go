@@ -2,25 +2,40 @@ package redkeep
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
+	"expvar"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
-const requeryDuration = 1 * time.Second
+const (
+	requeryDuration    = 1 * time.Second
+	checkpointInterval = 1 * time.Second
+)
 
 //TailAgent the worker that tails the database
 type TailAgent struct {
-	config    Configuration
-	session   *mgo.Session
-	tracker   Tracker
-	startTime time.Time
+	config     Configuration
+	session    *mgo.Session
+	tracker    Tracker
+	checkpoint CheckpointStore
+	startTime  time.Time
+
+	//pools counts the worker pools whose handlers are
+	//still running, Close waits until all of them returned
+	pools *sync.WaitGroup
+
+	dryRunOutput *os.File
 }
 
 //Query represents a mongodb oplog query
@@ -83,67 +98,132 @@ func (m mongoTimestamp) MongoTimestamp() bson.MongoTimestamp {
 	return bson.MongoTimestamp(result)
 }
 
-func analyzeResult(dataset map[string]interface{}, w []Watch, s *mgo.Session) {
+//analyzeResult passes the oplog entry dataset to all watches it concerns.
+//If one of them fails, the others are still handled and the error is
+//returned, the entry has to be analyzed again then.
+func analyzeResult(dataset map[string]interface{}, w []Watch, t Tracker) error {
 	query, err := NewOplogQuery(dataset)
 	if err != nil {
 		log.Println(err)
-		return
+		return nil
 	}
 
-	session := s.Copy()
-	defer session.Close()
-
-	t := NewChangeTracker(session)
 	watches := w
 	triggerDB := query.DB()
 	triggerCollection := query.C()
 	operationType := query.OP()
 	namespace := fmt.Sprintf("%s.%s", triggerDB, triggerCollection)
 
+	var failed error
+	handled := func(err error) {
+		if err != nil {
+			log.Println("Query could not be executed successfully: " + err.Error())
+			failed = err
+		}
+	}
+
 	if command, ok := dataset["o"].(map[string]interface{}); ok {
-		triggerID, _ := command["_id"].(bson.ObjectId)
 		triggerRef := mgo.DBRef{
 			Database:   triggerDB,
-			Id:         triggerID,
+			Id:         command["_id"],
 			Collection: triggerCollection,
 		}
 
 		for _, w := range watches {
+			if isSummary(w) || isAggregate(w) {
+				handled(analyzeReverse(dataset, w, t, namespace, operationType))
+				continue
+			}
+
+			if operationType == "u" {
+				handled(analyzeHops(dataset, w, t, namespace, command))
+			}
+
 			switch operationType {
 			case "i":
 				if w.TargetCollection == namespace {
-					t.HandleInsert(w, command, triggerRef)
+					handled(t.HandleInsert(w, command, triggerRef))
 				}
 			case "u":
-				if w.TargetCollection == namespace {
+				//targets might use any _id, not only ObjectIds
+				if id := GetValue("o2._id", dataset); w.TargetCollection == namespace && id != nil {
 					triggerRef := mgo.DBRef{
 						Collection: triggerCollection,
 						Database:   triggerDB,
-						Id:         dataset["o2"].(map[string]interface{})["_id"].(bson.ObjectId),
+						Id:         id,
 					}
 
-					t.HandleInsert(w, command, triggerRef)
+					handled(t.HandleInsert(w, command, triggerRef))
 				}
 
 				if w.TrackCollection == namespace {
 					if selector, ok := dataset["o2"].(map[string]interface{}); ok {
-						t.HandleUpdate(w, command, selector)
+						handled(t.HandleUpdate(w, command, selector))
 					}
 				}
 			case "d":
+				//the removed document is only identified by o
 				if w.TrackCollection == namespace {
-					if selector, ok := dataset["o2"].(map[string]interface{}); ok {
-						t.HandleRemove(w, command, selector)
-					}
+					handled(t.HandleRemove(w, command, command))
 				}
 			case "c":
 				//system commands. We do not care.
 			default:
 				log.Printf("unsupported operation %s.\n", operationType)
-				return
+				return failed
 			}
 		}
 	}
+
+	return failed
+}
+
+//analyzeReverse passes every change of a summarized
+//or aggregated document to t
+func analyzeReverse(dataset map[string]interface{}, w Watch, t Tracker, namespace, operationType string) error {
+	reverse, ok := t.(ReverseTracker)
+	if !ok || w.TrackCollection != namespace {
+		return nil
+	}
+
+	var id interface{}
+	switch operationType {
+	case "i", "d":
+		id = GetValue("o._id", dataset)
+	case "u":
+		id = GetValue("o2._id", dataset)
+	}
+
+	if id == nil {
+		return nil
+	}
+
+	return reverse.HandleChildChange(w, id)
+}
+
+//analyzeHops passes every change of a reference
+//inside of an intermediate document of w to t
+func analyzeHops(dataset map[string]interface{}, w Watch, t Tracker, namespace string, command map[string]interface{}) error {
+	hops, ok := t.(HopTracker)
+	if !ok {
+		return nil
+	}
+
+	id := GetValue("o2._id", dataset)
+	for i, hop := range w.Via {
+		if hop.Collection != namespace || id == nil {
+			continue
+		}
+
+		reference := Watch{TrackFields: []string{hop.TriggerReference}}
+		if isReplacement(command) || TouchesTrackedFields(reference, command) {
+			if err := hops.HandleHopChange(w, i, id); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
 }
 
 //getReference tries to create a reference from target
@@ -162,64 +242,343 @@ func getReference(target interface{}, originalDatabase string) (mgo.DBRef, bool)
 	return mgo.DBRef{Collection: col, Id: id, Database: db}, okID && okRef
 }
 
+//oplogGaps counts the detected oplog gaps, it is published via expvar
+var oplogGaps = expvar.NewInt("redkeepOplogGaps")
+
+//OplogGapError is returned if the oplog does not reach back to
+//the timestamp tailing resumes from, changes in between are lost
+type OplogGapError struct {
+	Resume, Oldest bson.MongoTimestamp
+}
+
+func (o OplogGapError) Error() string {
+	return fmt.Sprintf(
+		"Oplog gap detected, resuming after %s but the oldest oplog entry is from %s",
+		time.Unix(int64(o.Resume>>32), 0).UTC(),
+		time.Unix(int64(o.Oldest>>32), 0).UTC(),
+	)
+}
+
+//ErrGracePeriodExceeded is returned by Run if queued oplog entries
+//could not be analyzed within the shutdown grace period
+var ErrGracePeriodExceeded = errors.New("Shutdown grace period exceeded, queued oplog entries were skipped")
+
 //Tail will start an inifite look that tails the oplog
 //as long as the channel does not get any input
 //forceRescan (Default false) will update anything from the lowest oplog timestamp
 //again. Can cause many redundant writes depending on your oplog size.
+//Tail is kept for compatibility, use Run instead.
 func (t TailAgent) Tail(quit chan bool, forceRescan bool) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	t.config.Agent.ForceRescan = t.config.Agent.ForceRescan || forceRescan
+	return t.Run(ctx)
+}
+
+//Run tails the oplog until ctx is done.
+//If a checkpoint is configured, tailing resumes after the stored timestamp.
+//On shutdown the queued oplog entries are analyzed for at most the
+//configured grace period, remaining entries are skipped and
+//ErrGracePeriodExceeded is returned. A failing cursor returns its error,
+//an OplogGapError is returned if changes might have been lost,
+//a regular shutdown returns nil.
+func (t TailAgent) Run(ctx context.Context) error {
 	session := t.session.Copy()
 	defer session.Close()
 
 	oplogCollection := session.DB("local").C("oplog.rs")
 
-	startTime := mongoTimestamp{t.startTime}
-	if forceRescan {
-		startTime = mongoTimestamp{time.Unix(0, 0)}
+	lastTimestamp, resumed, err := t.startTimestamp(t.config.Agent.ForceRescan)
+	if err != nil {
+		return err
 	}
 
-	query := oplogCollection.Find(bson.M{"ts": bson.M{"$gt": startTime.MongoTimestamp()}})
-	iter := query.LogReplay().Sort("$natural").Tail(requeryDuration)
+	if resumed {
+		oldest, err := oldestTimestamp(oplogCollection)
+		if err != nil {
+			return err
+		}
 
-	sessionCopy := session.Copy()
-	var lastTimestamp bson.MongoTimestamp
-	for {
-		select {
-		case <-quit:
-			log.Println("Agent stopped.")
-			return nil
-		default:
+		if err := t.handleGap(oplogCollection.Database.Session, lastTimestamp, oldest); err != nil {
+			return err
 		}
+	}
+
+	window := newPendingWindow(lastTimestamp)
+	defer t.saveCheckpoint(window)
+
+	pool := newWorkerPool(t.config.Agent.Workers, t.config.Agent.QueueSize, func(task oplogTask, aborted <-chan struct{}) {
+		if t.analyze(task.dataset, aborted) {
+			window.finish(task.entry)
+		}
+	})
+
+	query := oplogCollection.Find(bson.M{"ts": bson.M{"$gt": lastTimestamp}})
+	iter := query.LogReplay().Sort("$natural").Tail(requeryDuration)
 
-		var result map[string]interface{}
+	t.pools.Add(1)
+	defer func() {
+		go func() {
+			pool.wait()
+			t.pools.Done()
+		}()
+	}()
+
+	err = t.tail(ctx, iter, oplogCollection, lastTimestamp, pool, window)
+	if !pool.drain(t.config.Agent.GracePeriod()) && err == nil {
+		err = ErrGracePeriodExceeded
+	}
 
+	log.Println("Agent stopped.")
+	return err
+}
+
+//tail dispatches all oplog entries to the worker pool until ctx is done
+//the cursor will be requeried if it dies
+func (t TailAgent) tail(
+	ctx context.Context,
+	iter *mgo.Iter,
+	oplogCollection *mgo.Collection,
+	lastTimestamp bson.MongoTimestamp,
+	pool *workerPool,
+	window *pendingWindow,
+) error {
+	lastCheckpoint := time.Now()
+	attempt := 0
+	var result map[string]interface{}
+	for {
 		for iter.Next(&result) {
+			attempt = 0
 			lastTimestamp = result["ts"].(bson.MongoTimestamp)
 
-			// in order to avoid a race condition, each routine needs
+			//saving the checkpoint creates oplog entries itself, analyzing
+			//them would advance the checkpoint and save it again forever
+			if t.isCheckpointEntry(result) {
+				continue
+			}
+
+			// in order to avoid a race condition, each worker needs
 			// copies from everything.
 			copyResult := make(map[string]interface{})
 			for k, v := range result {
 				copyResult[k] = v
 			}
 
-			go analyzeResult(copyResult, t.config.Watches[:], sessionCopy)
+			if !pool.dispatch(ctx, oplogTask{dataset: copyResult, entry: window.add(lastTimestamp)}) {
+				return iter.Close()
+			}
+
+			if time.Since(lastCheckpoint) > checkpointInterval {
+				t.saveCheckpoint(window)
+				lastCheckpoint = time.Now()
+			}
+
+			if ctx.Err() != nil {
+				return iter.Close()
+			}
 		}
 
-		if iter.Err() != nil {
+		t.saveCheckpoint(window)
+		lastCheckpoint = time.Now()
+
+		if ctx.Err() != nil {
 			return iter.Close()
 		}
 
-		if iter.Timeout() {
+		if err := iter.Err(); err != nil {
+			iter.Close()
+
+			//a failing gap probe is just another failed attempt,
+			//the primary might not be elected yet
+			var oldest bson.MongoTimestamp
+			for err != nil {
+				attempt++
+				if !t.awaitReconnect(ctx, attempt, err) {
+					return err
+				}
+
+				if ctx.Err() != nil {
+					return nil
+				}
+
+				oplogCollection.Database.Session.Refresh()
+				oldest, err = oldestTimestamp(oplogCollection)
+			}
+
+			if err := t.handleGap(oplogCollection.Database.Session, lastTimestamp, oldest); err != nil {
+				return err
+			}
+		} else if iter.Timeout() {
+			attempt = 0
 			continue
 		}
 
 		query := oplogCollection.Find(bson.M{"ts": bson.M{"$gt": lastTimestamp}})
 		iter = query.LogReplay().Sort("$natural").Tail(requeryDuration)
 	}
+}
+
+//analyze analyzes the oplog entry dataset, failures are retried with the
+//reconnect backoff. If the retries are exhausted or the pool is aborted,
+//false is returned and the entry must not be finished, so the checkpoint
+//never advances beyond changes that have not been applied.
+func (t TailAgent) analyze(dataset map[string]interface{}, aborted <-chan struct{}) bool {
+	settings := t.config.Agent.Reconnect
+	for attempt := 1; ; attempt++ {
+		err := analyzeResult(dataset, t.config.Watches[:], t.tracker)
+		if err == nil {
+			return true
+		}
+
+		if !settings.Retries(attempt) {
+			log.Printf("Oplog entry could not be analyzed: %s, giving up after %d attempts.\n", err, attempt-1)
+			return false
+		}
+
+		delay := settings.Backoff(attempt)
+		log.Printf("Oplog entry could not be analyzed: %s, retry %d in %s.\n", err, attempt, delay)
+
+		select {
+		case <-time.After(delay):
+		case <-aborted:
+			return false
+		}
+	}
+}
+
+//awaitReconnect waits before the next reconnect attempt,
+//it returns false if the retry budget is exhausted
+func (t TailAgent) awaitReconnect(ctx context.Context, attempt int, err error) bool {
+	settings := t.config.Agent.Reconnect
+	if !settings.Retries(attempt) {
+		log.Printf("Oplog cursor failed: %s, giving up after %d attempts.\n", err, attempt-1)
+		return false
+	}
+
+	delay := settings.Backoff(attempt)
+	log.Printf("Oplog cursor failed: %s, reconnect attempt %d in %s.\n", err, attempt, delay)
+
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+	}
+
+	return true
+}
+
+//isCheckpointEntry returns true if dataset is a write of the checkpoint store
+func (t TailAgent) isCheckpointEntry(dataset map[string]interface{}) bool {
+	store, ok := t.checkpoint.(mongoCheckpointStore)
+	return ok && dataset["ns"] == store.database+"."+store.name
+}
+
+//startTimestamp returns the timestamp after which tailing starts
+//and whether it has been loaded from the checkpoint
+func (t TailAgent) startTimestamp(forceRescan bool) (bson.MongoTimestamp, bool, error) {
+	if forceRescan {
+		return mongoTimestamp{time.Unix(0, 0)}.MongoTimestamp(), false, nil
+	}
+
+	if t.checkpoint != nil {
+		ts, err := t.checkpoint.Load()
+		if err != nil {
+			return 0, false, err
+		}
+
+		if ts > 0 {
+			log.Println("Resuming from checkpoint.")
+			return ts, true, nil
+		}
+	}
+
+	return mongoTimestamp{t.startTime}.MongoTimestamp(), false, nil
+}
+
+//oldestTimestamp returns the timestamp of the oldest
+//oplog entry, or 0 if the oplog is empty
+func oldestTimestamp(oplogCollection *mgo.Collection) (bson.MongoTimestamp, error) {
+	var oldest struct {
+		Timestamp bson.MongoTimestamp `bson:"ts"`
+	}
+
+	err := oplogCollection.Find(nil).Sort("$natural").One(&oldest)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	}
+
+	return oldest.Timestamp, err
+}
+
+//handleGap checks whether the oplog, starting at oldest, still reaches back to ts.
+//If it does not, changes might have been lost and an OplogGapError is
+//returned, unless BackfillOnGap is enabled, then all watches are backfilled.
+func (t TailAgent) handleGap(session *mgo.Session, ts, oldest bson.MongoTimestamp) error {
+	if oldest == 0 || oldest <= ts {
+		return nil
+	}
+
+	gap := OplogGapError{Resume: ts, Oldest: oldest}
+	oplogGaps.Add(1)
+	log.Println("ERROR:", gap)
+
+	if !t.config.Agent.BackfillOnGap {
+		return gap
+	}
+
+	if t.config.Agent.DryRun {
+		log.Println("Skipping backfill in dry run.")
+		return nil
+	}
+
+	log.Println("Backfilling all watches.")
+	for _, w := range t.config.Watches {
+		err := Backfill(session, w, BackfillOptions{
+			Progress: func(p BackfillProgress) {
+				log.Printf("Backfilling %s: %d/%d\n", w.TargetCollection, p.Processed, p.Total)
+			},
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//saveCheckpoint persists the timestamp up to which
+//every oplog entry has been analyzed completely
+func (t TailAgent) saveCheckpoint(window *pendingWindow) {
+	ts, changed := window.advanced()
+	if t.checkpoint == nil || !changed || t.config.Agent.DryRun {
+		return
+	}
+
+	if err := t.checkpoint.Save(ts); err != nil {
+		log.Println("Checkpoint could not be saved: " + err.Error())
+		return
+	}
 
-	iter.Close()
+	window.saved(ts)
+}
 
-	return errors.New("Tailable cursor ended unexpectedly")
+//Close closes the connection of the agent. Handlers that were still
+//running when Run returned are awaited first, they use the connection.
+func (t *TailAgent) Close() {
+	t.pools.Wait()
+	t.session.Close()
+	if t.dryRunOutput != nil {
+		t.dryRunOutput.Close()
+	}
 }
 
 func (t *TailAgent) connect() error {
@@ -234,13 +593,36 @@ func (t *TailAgent) connect() error {
 	t.session = session
 	t.tracker = NewChangeTracker(t.session)
 
+	if t.config.Agent.DryRun {
+		out := io.Writer(os.Stdout)
+		if t.config.Agent.DryRunOutput != "" {
+			file, err := os.OpenFile(t.config.Agent.DryRunOutput, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return err
+			}
+
+			t.dryRunOutput = file
+			out = file
+		}
+
+		log.Println("Dry run, no queries will be executed.")
+		t.tracker = NewDryRunTracker(t.session, out)
+	}
+
+	checkpoint, err := NewCheckpointStore(t.config.Checkpoint, t.session)
+	if err != nil {
+		return err
+	}
+
+	t.checkpoint = checkpoint
+
 	log.Println("Connected.")
 	return nil
 }
 
 //NewTailAgentWithStartDate will start
 func NewTailAgentWithStartDate(c Configuration, startTime time.Time) (*TailAgent, error) {
-	agent := &TailAgent{config: c, startTime: startTime}
+	agent := &TailAgent{config: c, startTime: startTime, pools: &sync.WaitGroup{}}
 	err := agent.connect()
 	return agent, err
 }
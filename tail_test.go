@@ -2,6 +2,8 @@ package redkeep_test
 
 import (
 	"bytes"
+	"context"
+	"expvar"
 	"fmt"
 	"io/ioutil"
 	"time"
@@ -53,13 +55,145 @@ var testConfigurationTemplate = `{
       "behaviourSettings": {
         "cascadeDelete": false
       }
+    },
+    {
+      "trackCollection": "{{.Database}}.user",
+      "trackFields": ["username"], 
+      "targetCollection": "{{.Database}}.review",
+      "targetNormalizedField": "meta",
+      "triggerReference": "user",
+      "behaviourSettings": {
+        "cascadeDelete": true
+      }
+    },
+    {
+      "trackCollection": "{{.Database}}.user",
+      "trackFields": ["username"], 
+      "targetCollection": "{{.Database}}.like",
+      "targetNormalizedField": "meta",
+      "triggerReference": "user",
+      "behaviourSettings": {
+        "onDelete": "nullify"
+      }
+    },
+    {
+      "trackCollection": "{{.Database}}.user",
+      "trackFields": ["username"], 
+      "targetCollection": "{{.Database}}.rating",
+      "targetNormalizedField": "meta",
+      "triggerReference": "user",
+      "behaviourSettings": {
+        "onDelete": "markOrphaned"
+      }
+    },
+    {
+      "trackCollection": "{{.Database}}.user",
+      "trackFields": ["username", "name.firstName"], 
+      "targetCollection": "{{.Database}}.mention",
+      "targetNormalizedField": "meta",
+      "triggerReference": "user",
+      "behaviourSettings": {
+        "updateMode": "refetch"
+      }
+    },
+    {
+      "trackCollection": "{{.Database}}.user",
+      "trackFields": ["username"], 
+      "targetCollection": "{{.Database}}.vote",
+      "targetNormalizedField": "meta",
+      "triggerReference": "userId",
+      "referenceType": "objectId",
+      "behaviourSettings": {
+        "onDelete": "unset"
+      }
+    },
+    {
+      "trackCollection": "{{.Database}}.user",
+      "trackFields": ["username"], 
+      "targetCollection": "{{.Database}}.visit",
+      "targetNormalizedField": "meta",
+      "triggerReference": "userId",
+      "referenceType": "string"
+    },
+    {
+      "trackCollection": "{{.Database}}.user",
+      "trackFields": ["username"], 
+      "targetCollection": "{{.Database}}.invite",
+      "targetNormalizedField": "meta",
+      "triggerReference": "email",
+      "referenceType": "scalar",
+      "referenceField": "email"
+    },
+    {
+      "trackCollection": "{{.Database}}.user",
+      "trackFields": ["username"], 
+      "targetCollection": "{{.Database}}.post",
+      "targetNormalizedField": "meta",
+      "triggerReference": "participants",
+      "referenceArray": true
+    },
+    {
+      "trackCollection": "{{.Database}}.user",
+      "trackFields": ["username"], 
+      "targetCollection": "{{.Database}}.question",
+      "targetNormalizedField": "meta",
+      "triggerReference": "answers.$[].author",
+      "behaviourSettings": {
+        "onDelete": "remove"
+      }
+    },
+    {
+      "kind": "summary",
+      "trackCollection": "{{.Database}}.note",
+      "trackFields": ["text"], 
+      "targetCollection": "{{.Database}}.user",
+      "targetNormalizedField": "latestNotes",
+      "triggerReference": "author",
+      "summary": {
+        "limit": 2
+      }
+    },
+    {
+      "kind": "aggregate",
+      "trackCollection": "{{.Database}}.note",
+      "targetCollection": "{{.Database}}.user",
+      "targetNormalizedField": "noteCount",
+      "triggerReference": "author",
+      "aggregate": {
+        "function": "count"
+      }
+    },
+    {
+      "kind": "aggregate",
+      "trackCollection": "{{.Database}}.note",
+      "targetCollection": "{{.Database}}.user",
+      "targetNormalizedField": "likeSum",
+      "triggerReference": "author",
+      "aggregate": {
+        "function": "sum",
+        "field": "likes"
+      }
+    },
+    {
+      "trackCollection": "{{.Database}}.user",
+      "trackFields": ["username"], 
+      "targetCollection": "{{.Database}}.reply",
+      "targetNormalizedField": "commentAuthor",
+      "triggerReference": "comment",
+      "via": [
+        {
+          "collection": "{{.Database}}.comment",
+          "triggerReference": "user"
+        }
+      ]
     }
   ]
 }`
 
 var _ = Describe("Tail", func() {
 	var (
-		running      chan bool
+		stop         context.CancelFunc
+		stopped      chan error
 		database     string
 		answerString string
 	)
@@ -71,7 +205,6 @@ var _ = Describe("Tail", func() {
 
 		database = rndDB
 
-		running = make(chan bool)
 		answerString = "this is my answer"
 
 		var data []byte
@@ -91,11 +224,17 @@ var _ = Describe("Tail", func() {
 		agent, err := NewTailAgent(*config)
 		Expect(err).ToNot(HaveOccurred())
 
-		go agent.Tail(running, false)
+		var ctx context.Context
+		ctx, stop = context.WithCancel(context.Background())
+		stopped = make(chan error)
+		go func() {
+			stopped <- agent.Run(ctx)
+		}()
 	})
 
 	AfterSuite(func() {
-		running <- false
+		stop()
+		Expect(<-stopped).ToNot(HaveOccurred())
 	})
 
 	Context("Database testcases", func() {
@@ -450,6 +589,1117 @@ var _ = Describe("Tail", func() {
 				Expect(actualComment.Meta["gender"]).To(Equal("confidential"))
 			}
 		})
+
+		It("will apply set and unset of one update together", func() {
+			err := db.DB(database).C("user").UpdateId(
+				userTwoRef.Id,
+				bson.M{
+					"$set":   bson.M{"username": "clint"},
+					"$unset": bson.M{"gender": ""},
+				},
+			)
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			actualComment := comment{}
+			db.Copy().DB(database).C("comment").Find(bson.M{"text": "hawkeye comment"}).One(&actualComment)
+
+			Expect(actualComment.Meta["username"]).To(Equal("clint"))
+			Expect(actualComment.Meta).ToNot(HaveKey("gender"))
+		})
+
+		It("will handle replaced users", func() {
+			err := db.DB(database).C("user").UpdateId(
+				userTwoRef.Id,
+				bson.M{
+					"username": "hawk",
+					"name": bson.M{
+						"firstName": "Clint",
+						"lastName":  "Barton",
+					},
+				},
+			)
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			actualAnswer := answer{}
+			db.Copy().DB(database).C("answer").Find(bson.M{"answerText": answerString}).One(&actualAnswer)
+			Expect(actualAnswer.Meta["username"]).To(Equal("hawk"))
+			Expect(actualAnswer.Meta["name"].(map[string]interface{})["firstName"]).To(Equal("Clint"))
+
+			err = db.DB(database).C("user").UpdateId(userTwoRef.Id, bson.M{"username": "hawk"})
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			replacedAnswer := answer{}
+			db.Copy().DB(database).C("answer").Find(bson.M{"answerText": answerString}).One(&replacedAnswer)
+			Expect(replacedAnswer.Meta["username"]).To(Equal("hawk"))
+			Expect(replacedAnswer.Meta).ToNot(HaveKey("name"))
+		})
+
+		It("will handle renames into tracked fields", func() {
+			err := db.DB(database).C("user").UpdateId(
+				userTwoRef.Id,
+				bson.M{"$set": bson.M{"fullName": bson.M{"firstName": "Hawk", "lastName": "Eye"}}},
+			)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = db.DB(database).C("user").UpdateId(
+				userTwoRef.Id,
+				bson.M{"$rename": bson.M{"fullName": "name"}},
+			)
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			renamedAnswer := answer{}
+			db.Copy().DB(database).C("answer").Find(bson.M{"answerText": answerString}).One(&renamedAnswer)
+			Expect(renamedAnswer.Meta["name"]).To(Equal(map[string]interface{}{
+				"firstName": "Hawk",
+				"lastName":  "Eye",
+			}))
+		})
+	})
+
+	Context("Remove testcases", func() {
+		var (
+			db *mgo.Session
+		)
+
+		BeforeEach(func() {
+			var err error
+			db, err = mgo.Dial("localhost:30000,localhost:30001,localhost:30002")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("will cascade deletes to referencing documents", func() {
+			userRef := mgo.DBRef{
+				Database:   database,
+				Id:         bson.NewObjectId(),
+				Collection: "user",
+			}
+
+			err := db.DB(database).C("user").Insert(bson.M{"_id": userRef.Id, "username": "ultron"})
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, text := range []string{"first review", "second review"} {
+				err = db.DB(database).C("review").Insert(bson.M{"text": text, "user": userRef})
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			err = db.DB(database).C("comment").Insert(bson.M{"text": "ultron comment", "user": userRef})
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			err = db.DB(database).C("user").RemoveId(userRef.Id)
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			n, err := db.Copy().DB(database).C("review").Find(bson.M{"user.$id": userRef.Id}).Count()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(0))
+
+			n, err = db.Copy().DB(database).C("comment").Find(bson.M{"user.$id": userRef.Id}).Count()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(1))
+		})
+
+		It("will nullify references and mark orphaned targets", func() {
+			userRef := mgo.DBRef{
+				Database:   database,
+				Id:         bson.NewObjectId(),
+				Collection: "user",
+			}
+
+			err := db.DB(database).C("user").Insert(bson.M{"_id": userRef.Id, "username": "loki"})
+			Expect(err).ToNot(HaveOccurred())
+
+			err = db.DB(database).C("like").Insert(bson.M{"text": "loki like", "user": userRef})
+			Expect(err).ToNot(HaveOccurred())
+
+			err = db.DB(database).C("rating").Insert(bson.M{"text": "loki rating", "user": userRef})
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			err = db.DB(database).C("user").RemoveId(userRef.Id)
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			like := bson.M{}
+			err = db.Copy().DB(database).C("like").Find(bson.M{"text": "loki like"}).One(&like)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(like).To(HaveKeyWithValue("user", nil))
+
+			rating := struct{ Meta map[string]interface{} }{}
+			err = db.Copy().DB(database).C("rating").Find(bson.M{"text": "loki rating"}).One(&rating)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rating.Meta).To(HaveKeyWithValue("deleted", true))
+			Expect(rating.Meta).To(HaveKey("deletedAt"))
+			Expect(rating.Meta).ToNot(HaveKey("username"))
+		})
+	})
+
+	Context("Ordering testcases", func() {
+		It("will apply updates of one user in order", func() {
+			db, err := mgo.Dial("localhost:30000,localhost:30001,localhost:30002")
+			Expect(err).ToNot(HaveOccurred())
+
+			userID := bson.NewObjectId()
+			userRef := mgo.DBRef{Database: database, Id: userID, Collection: "user"}
+			err = db.DB(database).C("user").Insert(bson.M{"_id": userID, "username": "quicksilver"})
+			Expect(err).ToNot(HaveOccurred())
+
+			err = db.DB(database).C("comment").Insert(bson.M{"text": "quicksilver comment", "user": userRef})
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			for i := 0; i < 100; i++ {
+				err = db.DB(database).C("user").UpdateId(userID, bson.M{"$set": bson.M{"username": fmt.Sprintf("quicksilver #%d", i)}})
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			time.Sleep(10 * sleepDuration)
+			actual := struct{ Meta map[string]interface{} }{}
+			err = db.Copy().DB(database).C("comment").Find(bson.M{"text": "quicksilver comment"}).One(&actual)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(actual.Meta["username"]).To(Equal("quicksilver #99"))
+		})
+	})
+
+	Context("Refetch testcases", func() {
+		It("will rewrite the normalized field from the current user", func() {
+			db, err := mgo.Dial("localhost:30000,localhost:30001,localhost:30002")
+			Expect(err).ToNot(HaveOccurred())
+
+			userID := bson.NewObjectId()
+			userRef := mgo.DBRef{Database: database, Id: userID, Collection: "user"}
+			err = db.DB(database).C("user").Insert(bson.M{
+				"_id":      userID,
+				"username": "vision",
+				"name":     bson.M{"firstName": "Vis", "lastName": "Ion"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			err = db.DB(database).C("mention").Insert(bson.M{"text": "vision mention", "user": userRef})
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			err = db.DB(database).C("user").UpdateId(userID, bson.M{
+				"$set":   bson.M{"name.firstName": "Victor"},
+				"$unset": bson.M{"username": ""},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			mention := struct{ Meta map[string]interface{} }{}
+			err = db.Copy().DB(database).C("mention").Find(bson.M{"text": "vision mention"}).One(&mention)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mention.Meta).To(Equal(map[string]interface{}{
+				"name": map[string]interface{}{"firstName": "Victor"},
+			}))
+		})
+	})
+
+	Context("Reference type testcases", func() {
+		It("will update targets whose _id is not an ObjectId", func() {
+			db, err := mgo.Dial("localhost:30000,localhost:30001,localhost:30002")
+			Expect(err).ToNot(HaveOccurred())
+
+			mantisID := bson.NewObjectId()
+			err = db.DB(database).C("user").Insert(bson.M{"_id": mantisID, "username": "mantis", "gender": "female"})
+			Expect(err).ToNot(HaveOccurred())
+
+			err = db.DB(database).C("comment").Insert(bson.M{"_id": "comment-with-string-id", "text": "sleep"})
+			Expect(err).ToNot(HaveOccurred())
+
+			err = db.DB(database).C("comment").UpdateId("comment-with-string-id", bson.M{"$set": bson.M{
+				"user": mgo.DBRef{Database: database, Id: mantisID, Collection: "user"},
+			}})
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			comment := struct{ Meta map[string]interface{} }{}
+			err = db.Copy().DB(database).C("comment").FindId("comment-with-string-id").One(&comment)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(comment.Meta).To(Equal(map[string]interface{}{"username": "mantis", "gender": "female"}))
+		})
+
+		It("will follow ObjectId references", func() {
+			db, err := mgo.Dial("localhost:30000,localhost:30001,localhost:30002")
+			Expect(err).ToNot(HaveOccurred())
+
+			userID := bson.NewObjectId()
+			err = db.DB(database).C("user").Insert(bson.M{"_id": userID, "username": "groot"})
+			Expect(err).ToNot(HaveOccurred())
+
+			err = db.DB(database).C("vote").Insert(bson.M{"text": "groot vote", "userId": userID})
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			vote := struct{ Meta map[string]interface{} }{}
+			err = db.Copy().DB(database).C("vote").Find(bson.M{"text": "groot vote"}).One(&vote)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(vote.Meta["username"]).To(Equal("groot"))
+
+			err = db.DB(database).C("user").UpdateId(userID, bson.M{"$set": bson.M{"username": "I am groot"}})
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			updated := struct{ Meta map[string]interface{} }{}
+			err = db.Copy().DB(database).C("vote").Find(bson.M{"text": "groot vote"}).One(&updated)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(updated.Meta["username"]).To(Equal("I am groot"))
+
+			err = db.DB(database).C("user").RemoveId(userID)
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			removed := struct{ Meta map[string]interface{} }{}
+			err = db.Copy().DB(database).C("vote").Find(bson.M{"text": "groot vote"}).One(&removed)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(removed.Meta).To(BeNil())
+		})
+
+		It("will follow string references", func() {
+			db, err := mgo.Dial("localhost:30000,localhost:30001,localhost:30002")
+			Expect(err).ToNot(HaveOccurred())
+
+			userID := bson.NewObjectId()
+			err = db.DB(database).C("user").Insert(bson.M{"_id": userID, "username": "rocket"})
+			Expect(err).ToNot(HaveOccurred())
+
+			err = db.DB(database).C("visit").Insert(bson.M{"text": "rocket visit", "userId": userID.Hex()})
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			err = db.DB(database).C("user").UpdateId(userID, bson.M{"$set": bson.M{"username": "rocket raccoon"}})
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			visit := struct{ Meta map[string]interface{} }{}
+			err = db.Copy().DB(database).C("visit").Find(bson.M{"text": "rocket visit"}).One(&visit)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(visit.Meta["username"]).To(Equal("rocket raccoon"))
+		})
+
+		It("will follow scalar references on another field", func() {
+			db, err := mgo.Dial("localhost:30000,localhost:30001,localhost:30002")
+			Expect(err).ToNot(HaveOccurred())
+
+			userID := bson.NewObjectId()
+			err = db.DB(database).C("user").Insert(bson.M{"_id": userID, "username": "drax", "email": "drax@example.com"})
+			Expect(err).ToNot(HaveOccurred())
+
+			err = db.DB(database).C("invite").Insert(bson.M{"text": "drax invite", "email": "drax@example.com"})
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			err = db.DB(database).C("user").UpdateId(userID, bson.M{"$set": bson.M{"username": "drax the destroyer"}})
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			invite := struct{ Meta map[string]interface{} }{}
+			err = db.Copy().DB(database).C("invite").Find(bson.M{"text": "drax invite"}).One(&invite)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(invite.Meta["username"]).To(Equal("drax the destroyer"))
+		})
+	})
+
+	Context("Reference array testcases", func() {
+		It("will denormalize every referenced document", func() {
+			db, err := mgo.Dial("localhost:30000,localhost:30001,localhost:30002")
+			Expect(err).ToNot(HaveOccurred())
+
+			gamoraID := bson.NewObjectId()
+			nebulaID := bson.NewObjectId()
+			err = db.DB(database).C("user").Insert(
+				bson.M{"_id": gamoraID, "username": "gamora"},
+				bson.M{"_id": nebulaID, "username": "nebula"},
+			)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = db.DB(database).C("post").Insert(bson.M{"text": "sisters", "participants": []mgo.DBRef{
+				{Database: database, Id: gamoraID, Collection: "user"},
+				{Database: database, Id: nebulaID, Collection: "user"},
+			}})
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			post := struct{ Meta map[string]interface{} }{}
+			err = db.Copy().DB(database).C("post").Find(bson.M{"text": "sisters"}).One(&post)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(post.Meta).To(Equal(map[string]interface{}{
+				gamoraID.Hex(): map[string]interface{}{"username": "gamora"},
+				nebulaID.Hex(): map[string]interface{}{"username": "nebula"},
+			}))
+
+			err = db.DB(database).C("user").UpdateId(nebulaID, bson.M{"$set": bson.M{"username": "nebula the sister"}})
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			updated := struct{ Meta map[string]interface{} }{}
+			err = db.Copy().DB(database).C("post").Find(bson.M{"text": "sisters"}).One(&updated)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(updated.Meta).To(Equal(map[string]interface{}{
+				gamoraID.Hex(): map[string]interface{}{"username": "gamora"},
+				nebulaID.Hex(): map[string]interface{}{"username": "nebula the sister"},
+			}))
+		})
+
+		It("will denormalize participants that are pushed onto an existing post", func() {
+			db, err := mgo.Dial("localhost:30000,localhost:30001,localhost:30002")
+			Expect(err).ToNot(HaveOccurred())
+
+			draxID, mantisID := bson.NewObjectId(), bson.NewObjectId()
+			err = db.DB(database).C("user").Insert(
+				bson.M{"_id": draxID, "username": "drax"},
+				bson.M{"_id": mantisID, "username": "mantis"},
+			)
+			Expect(err).ToNot(HaveOccurred())
+
+			postID := bson.NewObjectId()
+			err = db.DB(database).C("post").Insert(bson.M{"_id": postID, "text": "friends", "participants": []mgo.DBRef{
+				{Database: database, Id: draxID, Collection: "user"},
+			}})
+			Expect(err).ToNot(HaveOccurred())
+
+			err = db.DB(database).C("post").UpdateId(postID, bson.M{"$push": bson.M{
+				"participants": mgo.DBRef{Database: database, Id: mantisID, Collection: "user"},
+			}})
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			post := struct{ Meta map[string]interface{} }{}
+			err = db.Copy().DB(database).C("post").FindId(postID).One(&post)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(post.Meta).To(Equal(map[string]interface{}{
+				draxID.Hex():   map[string]interface{}{"username": "drax"},
+				mantisID.Hex(): map[string]interface{}{"username": "mantis"},
+			}))
+
+			err = db.DB(database).C("post").UpdateId(postID, bson.M{"$pull": bson.M{
+				"participants": bson.M{"$id": draxID},
+			}})
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			post = struct{ Meta map[string]interface{} }{}
+			err = db.Copy().DB(database).C("post").FindId(postID).One(&post)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(post.Meta).To(Equal(map[string]interface{}{
+				mantisID.Hex(): map[string]interface{}{"username": "mantis"},
+			}))
+
+			err = db.DB(database).C("post").UpdateId(postID, bson.M{"$set": bson.M{
+				"meta." + draxID.Hex(): bson.M{"username": "drax"},
+			}})
+			Expect(err).ToNot(HaveOccurred())
+
+			w := Watch{
+				TrackCollection:       database + ".user",
+				TrackFields:           []string{"username"},
+				TargetCollection:      database + ".post",
+				TargetNormalizedField: "meta",
+				TriggerReference:      "participants",
+				ReferenceArray:        true,
+			}
+
+			var drifts []Drift
+			_, err = Verify(db, w, func(d Drift) {
+				if d.ID == postID {
+					drifts = append(drifts, d)
+				}
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(drifts).To(HaveLen(1))
+			Expect(drifts[0].Fields).To(Equal([]FieldDrift{{
+				Target:  "meta." + draxID.Hex(),
+				Actual:  map[string]interface{}{"username": "drax"},
+				Missing: true,
+			}}))
+		})
+	})
+
+	Context("Embedded reference testcases", func() {
+		It("will denormalize into every matching subdocument", func() {
+			db, err := mgo.Dial("localhost:30000,localhost:30001,localhost:30002")
+			Expect(err).ToNot(HaveOccurred())
+
+			starlordID := bson.NewObjectId()
+			mantisID := bson.NewObjectId()
+			err = db.DB(database).C("user").Insert(
+				bson.M{"_id": starlordID, "username": "starlord"},
+				bson.M{"_id": mantisID, "username": "mantis"},
+			)
+			Expect(err).ToNot(HaveOccurred())
+
+			starlordRef := mgo.DBRef{Database: database, Id: starlordID, Collection: "user"}
+			mantisRef := mgo.DBRef{Database: database, Id: mantisID, Collection: "user"}
+			questionID := bson.NewObjectId()
+			err = db.DB(database).C("question").Insert(bson.M{"_id": questionID, "answers": []bson.M{
+				{"author": starlordRef, "text": "dance off"},
+				{"author": mantisRef, "text": "i am an empath"},
+			}})
+			Expect(err).ToNot(HaveOccurred())
+
+			type answer struct {
+				Text string
+				Meta map[string]interface{}
+			}
+
+			time.Sleep(sleepDuration)
+			question := struct{ Answers []answer }{}
+			err = db.Copy().DB(database).C("question").FindId(questionID).One(&question)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(question.Answers).To(HaveLen(2))
+			Expect(question.Answers[0].Meta["username"]).To(Equal("starlord"))
+			Expect(question.Answers[1].Meta["username"]).To(Equal("mantis"))
+
+			err = db.DB(database).C("question").UpdateId(questionID, bson.M{
+				"$push": bson.M{"answers": bson.M{"author": starlordRef, "text": "we are groot"}},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			err = db.DB(database).C("user").UpdateId(starlordID, bson.M{"$set": bson.M{"username": "peter quill"}})
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			updated := struct{ Answers []answer }{}
+			err = db.Copy().DB(database).C("question").FindId(questionID).One(&updated)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(updated.Answers).To(HaveLen(3))
+			Expect(updated.Answers[0].Meta["username"]).To(Equal("peter quill"))
+			Expect(updated.Answers[1].Meta["username"]).To(Equal("mantis"))
+			Expect(updated.Answers[2].Meta["username"]).To(Equal("peter quill"))
+
+			err = db.DB(database).C("user").RemoveId(starlordID)
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			removed := struct{ Answers []answer }{}
+			err = db.Copy().DB(database).C("question").FindId(questionID).One(&removed)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(removed.Answers).To(HaveLen(1))
+			Expect(removed.Answers[0].Text).To(Equal("i am an empath"))
+		})
+	})
+
+	Context("Summary testcases", func() {
+		It("will keep the latest children in the parent", func() {
+			db, err := mgo.Dial("localhost:30000,localhost:30001,localhost:30002")
+			Expect(err).ToNot(HaveOccurred())
+
+			userID := bson.NewObjectId()
+			userRef := mgo.DBRef{Database: database, Id: userID, Collection: "user"}
+			err = db.DB(database).C("user").Insert(bson.M{"_id": userID, "username": "yondu"})
+			Expect(err).ToNot(HaveOccurred())
+
+			firstID, secondID, thirdID := bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId()
+			err = db.DB(database).C("note").Insert(
+				bson.M{"_id": firstID, "text": "first", "author": userRef},
+				bson.M{"_id": secondID, "text": "second", "author": userRef},
+				bson.M{"_id": thirdID, "text": "third", "author": userRef},
+			)
+			Expect(err).ToNot(HaveOccurred())
+
+			type user struct {
+				LatestNotes []map[string]interface{} `bson:"latestNotes"`
+			}
+
+			time.Sleep(sleepDuration)
+			actual := user{}
+			err = db.Copy().DB(database).C("user").FindId(userID).One(&actual)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(actual.LatestNotes).To(Equal([]map[string]interface{}{
+				{"_id": thirdID, "text": "third"},
+				{"_id": secondID, "text": "second"},
+			}))
+
+			err = db.DB(database).C("note").UpdateId(secondID, bson.M{"$set": bson.M{"text": "second edited"}})
+			Expect(err).ToNot(HaveOccurred())
+			err = db.DB(database).C("note").RemoveId(thirdID)
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			updated := user{}
+			err = db.Copy().DB(database).C("user").FindId(userID).One(&updated)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(updated.LatestNotes).To(Equal([]map[string]interface{}{
+				{"_id": secondID, "text": "second edited"},
+				{"_id": firstID, "text": "first"},
+			}))
+		})
+	})
+
+	Context("Aggregate testcases", func() {
+		It("will keep counts and sums of the children up to date", func() {
+			db, err := mgo.Dial("localhost:30000,localhost:30001,localhost:30002")
+			Expect(err).ToNot(HaveOccurred())
+
+			kraglinID, taserfaceID := bson.NewObjectId(), bson.NewObjectId()
+			kraglinRef := mgo.DBRef{Database: database, Id: kraglinID, Collection: "user"}
+			taserfaceRef := mgo.DBRef{Database: database, Id: taserfaceID, Collection: "user"}
+			err = db.DB(database).C("user").Insert(
+				bson.M{"_id": kraglinID, "username": "kraglin"},
+				bson.M{"_id": taserfaceID, "username": "taserface"},
+			)
+			Expect(err).ToNot(HaveOccurred())
+
+			firstID, secondID := bson.NewObjectId(), bson.NewObjectId()
+			err = db.DB(database).C("note").Insert(
+				bson.M{"_id": firstID, "text": "arrows", "author": kraglinRef, "likes": 3},
+				bson.M{"_id": secondID, "text": "whistle", "author": kraglinRef, "likes": 4},
+			)
+			Expect(err).ToNot(HaveOccurred())
+
+			type user struct {
+				NoteCount int `bson:"noteCount"`
+				LikeSum   int `bson:"likeSum"`
+			}
+
+			time.Sleep(sleepDuration)
+			kraglin := user{}
+			err = db.Copy().DB(database).C("user").FindId(kraglinID).One(&kraglin)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(kraglin).To(Equal(user{NoteCount: 2, LikeSum: 7}))
+
+			err = db.DB(database).C("note").UpdateId(secondID, bson.M{"$set": bson.M{"author": taserfaceRef}})
+			Expect(err).ToNot(HaveOccurred())
+			err = db.DB(database).C("note").RemoveId(firstID)
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			kraglin = user{}
+			err = db.Copy().DB(database).C("user").FindId(kraglinID).One(&kraglin)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(kraglin).To(Equal(user{NoteCount: 0, LikeSum: 0}))
+
+			taserface := user{}
+			err = db.Copy().DB(database).C("user").FindId(taserfaceID).One(&taserface)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(taserface).To(Equal(user{NoteCount: 1, LikeSum: 4}))
+		})
+
+		It("will not lose updates if many children of one parent change at once", func() {
+			db, err := mgo.Dial("localhost:30000,localhost:30001,localhost:30002")
+			Expect(err).ToNot(HaveOccurred())
+
+			grootID := bson.NewObjectId()
+			grootRef := mgo.DBRef{Database: database, Id: grootID, Collection: "user"}
+			err = db.DB(database).C("user").Insert(bson.M{"_id": grootID, "username": "groot"})
+			Expect(err).ToNot(HaveOccurred())
+
+			const burst = 200
+			var lastID bson.ObjectId
+			bulk := db.DB(database).C("note").Bulk()
+			for i := 0; i < burst; i++ {
+				lastID = bson.NewObjectId()
+				bulk.Insert(bson.M{"_id": lastID, "text": fmt.Sprintf("I am groot %d", i), "author": grootRef, "likes": 1})
+			}
+
+			_, err = bulk.Run()
+			Expect(err).ToNot(HaveOccurred())
+
+			type user struct {
+				NoteCount   int                      `bson:"noteCount"`
+				LikeSum     int                      `bson:"likeSum"`
+				LatestNotes []map[string]interface{} `bson:"latestNotes"`
+			}
+
+			time.Sleep(10 * sleepDuration)
+			groot := user{}
+			err = db.Copy().DB(database).C("user").FindId(grootID).One(&groot)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(groot.NoteCount).To(Equal(burst))
+			Expect(groot.LikeSum).To(Equal(burst))
+			Expect(groot.LatestNotes).To(HaveLen(2))
+			Expect(groot.LatestNotes[0]["_id"]).To(Equal(lastID))
+		})
+	})
+
+	Context("Chain testcases", func() {
+		It("will follow changes through every hop", func() {
+			db, err := mgo.Dial("localhost:30000,localhost:30001,localhost:30002")
+			Expect(err).ToNot(HaveOccurred())
+
+			yonduID, nebulaID := bson.NewObjectId(), bson.NewObjectId()
+			err = db.DB(database).C("user").Insert(
+				bson.M{"_id": yonduID, "username": "yondu"},
+				bson.M{"_id": nebulaID, "username": "nebula"},
+			)
+			Expect(err).ToNot(HaveOccurred())
+
+			commentID := bson.NewObjectId()
+			err = db.DB(database).C("comment").Insert(bson.M{
+				"_id":  commentID,
+				"text": "I'm Mary Poppins, y'all!",
+				"user": mgo.DBRef{Database: database, Id: yonduID, Collection: "user"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			replyID := bson.NewObjectId()
+			err = db.DB(database).C("reply").Insert(bson.M{
+				"_id":     replyID,
+				"comment": mgo.DBRef{Database: database, Id: commentID, Collection: "comment"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			type reply struct {
+				CommentAuthor map[string]interface{} `bson:"commentAuthor"`
+			}
+
+			time.Sleep(sleepDuration)
+			actual := reply{}
+			err = db.Copy().DB(database).C("reply").FindId(replyID).One(&actual)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(actual.CommentAuthor).To(Equal(map[string]interface{}{"username": "yondu"}))
+
+			err = db.DB(database).C("user").UpdateId(yonduID, bson.M{"$set": bson.M{"username": "udonta"}})
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			actual = reply{}
+			err = db.Copy().DB(database).C("reply").FindId(replyID).One(&actual)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(actual.CommentAuthor).To(Equal(map[string]interface{}{"username": "udonta"}))
+
+			err = db.DB(database).C("comment").UpdateId(commentID, bson.M{"$set": bson.M{
+				"user": mgo.DBRef{Database: database, Id: nebulaID, Collection: "user"},
+			}})
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			actual = reply{}
+			err = db.Copy().DB(database).C("reply").FindId(replyID).One(&actual)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(actual.CommentAuthor).To(Equal(map[string]interface{}{"username": "nebula"}))
+		})
+	})
+
+	Context("Backfill testcases", func() {
+		It("will denormalize existing documents", func() {
+			db, err := mgo.Dial("localhost:30000,localhost:30001,localhost:30002")
+			Expect(err).ToNot(HaveOccurred())
+
+			userID := bson.NewObjectId()
+			userRef := mgo.DBRef{Database: database, Id: userID, Collection: "user"}
+			err = db.DB(database).C("user").Insert(bson.M{"_id": userID, "username": "thor", "gender": "male"})
+			Expect(err).ToNot(HaveOccurred())
+
+			err = db.DB(database).C("legacy").Insert(bson.M{"text": "thor legacy", "user": userRef})
+			Expect(err).ToNot(HaveOccurred())
+
+			w := Watch{
+				TrackCollection:       database + ".user",
+				TrackFields:           []string{"username"},
+				TargetCollection:      database + ".legacy",
+				TargetNormalizedField: "meta",
+				TriggerReference:      "user",
+			}
+
+			var progress BackfillProgress
+			Expect(Backfill(db, w, BackfillOptions{
+				BatchSize: 1,
+				Progress:  func(p BackfillProgress) { progress = p },
+			})).To(Succeed())
+			Expect(progress.Processed).To(Equal(1))
+			Expect(progress.Updated).To(Equal(1))
+
+			actual := struct{ Meta map[string]interface{} }{}
+			err = db.Copy().DB(database).C("legacy").Find(bson.M{"text": "thor legacy"}).One(&actual)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(actual.Meta).To(Equal(map[string]interface{}{"username": "thor"}))
+		})
+
+		It("will report drift of normalized fields", func() {
+			db, err := mgo.Dial("localhost:30000,localhost:30001,localhost:30002")
+			Expect(err).ToNot(HaveOccurred())
+
+			w := Watch{
+				TrackCollection:       database + ".user",
+				TrackFields:           []string{"username"},
+				TargetCollection:      database + ".legacy",
+				TargetNormalizedField: "meta",
+				TriggerReference:      "user",
+			}
+
+			report, err := Verify(db, w, func(d Drift) {
+				Fail("unexpected drift")
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(report.Checked).To(Equal(1))
+
+			_, err = db.DB(database).C("legacy").UpdateAll(bson.M{"text": "thor legacy"}, bson.M{"$set": bson.M{"meta.username": "loki"}})
+			Expect(err).ToNot(HaveOccurred())
+
+			danglingRef := mgo.DBRef{Database: database, Id: bson.NewObjectId(), Collection: "user"}
+			err = db.DB(database).C("legacy").Insert(bson.M{"text": "dangling legacy", "user": danglingRef})
+			Expect(err).ToNot(HaveOccurred())
+
+			err = db.DB(database).C("legacy").Insert(bson.M{"text": "missing legacy"})
+			Expect(err).ToNot(HaveOccurred())
+
+			var drifts []Drift
+			report, err = Verify(db, w, func(d Drift) {
+				drifts = append(drifts, d)
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(report).To(Equal(VerifyReport{Checked: 3, Mismatches: 1, MissingReferences: 1, DanglingReferences: 1}))
+			Expect(drifts).To(HaveLen(3))
+			Expect(drifts[0].Kind).To(Equal(DriftMismatch))
+			Expect(drifts[0].Fields).To(Equal([]FieldDrift{{Field: "username", Target: "meta.username", Expected: "thor", Actual: "loki"}}))
+		})
+
+		It("will repair drifted normalized fields", func() {
+			db, err := mgo.Dial("localhost:30000,localhost:30001,localhost:30002")
+			Expect(err).ToNot(HaveOccurred())
+
+			w := Watch{
+				TrackCollection:       database + ".user",
+				TrackFields:           []string{"username"},
+				TargetCollection:      database + ".legacy",
+				TargetNormalizedField: "meta",
+				TriggerReference:      "user",
+			}
+
+			report, err := Repair(db, w, RepairOptions{DryRun: true})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(report.Mismatches).To(Equal(1))
+			Expect(report.Repaired).To(Equal(0))
+
+			report, err = Repair(db, w, RepairOptions{BatchSize: 2, RateLimit: 100})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(report.Mismatches).To(Equal(1))
+			Expect(report.Repaired).To(Equal(1))
+
+			actual := struct{ Meta map[string]interface{} }{}
+			err = db.Copy().DB(database).C("legacy").Find(bson.M{"text": "thor legacy"}).One(&actual)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(actual.Meta).To(Equal(map[string]interface{}{"username": "thor"}))
+		})
+
+		It("will write at most rate limit targets per second", func() {
+			db, err := mgo.Dial("localhost:30000,localhost:30001,localhost:30002")
+			Expect(err).ToNot(HaveOccurred())
+
+			userRef := mgo.DBRef{Database: database, Id: bson.NewObjectId(), Collection: "user"}
+			err = db.DB(database).C("user").Insert(bson.M{"_id": userRef.Id, "username": "hela"})
+			Expect(err).ToNot(HaveOccurred())
+
+			for i := 0; i < 5; i++ {
+				err = db.DB(database).C("pacedLegacy").Insert(bson.M{"user": userRef, "meta": bson.M{"username": "odin"}})
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			w := Watch{
+				TrackCollection:       database + ".user",
+				TrackFields:           []string{"username"},
+				TargetCollection:      database + ".pacedLegacy",
+				TargetNormalizedField: "meta",
+				TriggerReference:      "user",
+			}
+
+			reports := make(chan RepairReport, 1)
+			go func() {
+				defer GinkgoRecover()
+				report, err := Repair(db, w, RepairOptions{RateLimit: 2})
+				Expect(err).ToNot(HaveOccurred())
+				reports <- report
+			}()
+
+			//the first two targets are written at once, the next two a second later
+			time.Sleep(500 * time.Millisecond)
+			n, err := db.Copy().DB(database).C("pacedLegacy").Find(bson.M{"meta.username": "hela"}).Count()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(2))
+
+			select {
+			case report := <-reports:
+				Expect(report.Repaired).To(Equal(5))
+			case <-time.After(5 * time.Second):
+				Fail("Repair did not finish")
+			}
+		})
+	})
+
+	Context("Scalar backfill testcases", func() {
+		It("will report scalar references to arrays and subdocuments as dangling", func() {
+			db, err := mgo.Dial("localhost:30000,localhost:30001,localhost:30002")
+			Expect(err).ToNot(HaveOccurred())
+
+			err = db.DB(database).C("user").Insert(bson.M{"username": "rocket", "email": "rocket@guardians"})
+			Expect(err).ToNot(HaveOccurred())
+
+			emails := []interface{}{"rocket@guardians", "groot@guardians"}
+			err = db.DB(database).C("scalarLegacy").Insert(
+				bson.M{"email": "rocket@guardians", "meta": bson.M{"username": "rocket"}},
+				bson.M{"email": emails},
+				bson.M{"email": emails},
+				bson.M{"email": bson.M{"address": "rocket@guardians"}},
+			)
+			Expect(err).ToNot(HaveOccurred())
+
+			w := Watch{
+				TrackCollection:       database + ".user",
+				TrackFields:           []string{"username"},
+				TargetCollection:      database + ".scalarLegacy",
+				TargetNormalizedField: "meta",
+				TriggerReference:      "email",
+				ReferenceType:         ReferenceScalar,
+				ReferenceField:        "email",
+			}
+
+			Expect(Backfill(db, w, BackfillOptions{})).To(Succeed())
+
+			report, err := Verify(db, w, func(d Drift) {
+				Expect(d.Kind).To(Equal(DriftDanglingReference))
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(report).To(Equal(VerifyReport{Checked: 4, DanglingReferences: 3}))
+		})
+	})
+
+	Context("Checkpoint testcases", func() {
+		checkpointConfig := func(name, target string) Configuration {
+			return Configuration{
+				Mongo: Mongo{ConnectionURI: "localhost:30000,localhost:30001,localhost:30002"},
+				Checkpoint: CheckpointSettings{
+					Type:       "mongo",
+					Collection: database + ".checkpoint",
+					Name:       name,
+				},
+				Watches: []Watch{{
+					TrackCollection:       database + ".user",
+					TrackFields:           []string{"username"},
+					TargetCollection:      database + "." + target,
+					TargetNormalizedField: "meta",
+					TriggerReference:      "user",
+				}},
+			}
+		}
+
+		run := func(config Configuration) (context.CancelFunc, chan error) {
+			agent, err := NewTailAgent(config)
+			Expect(err).ToNot(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			result := make(chan error, 1)
+			go func() {
+				result <- agent.Run(ctx)
+				agent.Close()
+			}()
+
+			return cancel, result
+		}
+
+		It("will save and load timestamps in mongo", func() {
+			db, err := mgo.Dial("localhost:30000,localhost:30001,localhost:30002")
+			Expect(err).ToNot(HaveOccurred())
+
+			store, err := NewCheckpointStore(CheckpointSettings{Type: "mongo", Collection: database + ".checkpoint", Name: "roundtrip"}, db)
+			Expect(err).ToNot(HaveOccurred())
+
+			ts, err := store.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ts).To(Equal(bson.MongoTimestamp(0)))
+
+			Expect(store.Save(bson.MongoTimestamp(1453743296<<32 | 7))).To(Succeed())
+			Expect(store.Save(bson.MongoTimestamp(1453743296<<32 | 8))).To(Succeed())
+
+			ts, err = store.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ts).To(Equal(bson.MongoTimestamp(1453743296<<32 | 8)))
+		})
+
+		It("will resume after the saved checkpoint on restart", func() {
+			db, err := mgo.Dial("localhost:30000,localhost:30001,localhost:30002")
+			Expect(err).ToNot(HaveOccurred())
+
+			userID := bson.NewObjectId()
+			err = db.DB(database).C("user").Insert(bson.M{"_id": userID, "username": "wanda"})
+			Expect(err).ToNot(HaveOccurred())
+
+			err = db.DB(database).C("resumeComment").Insert(bson.M{
+				"text": "resume",
+				"user": mgo.DBRef{Database: database, Id: userID, Collection: "user"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			config := checkpointConfig("resume", "resumeComment")
+			cancel, result := run(config)
+
+			err = db.DB(database).C("user").UpdateId(userID, bson.M{"$set": bson.M{"username": "scarlet"}})
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			cancel()
+			Expect(<-result).ToNot(HaveOccurred())
+
+			store, err := NewCheckpointStore(config.Checkpoint, db)
+			Expect(err).ToNot(HaveOccurred())
+			saved, err := store.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(saved).ToNot(Equal(bson.MongoTimestamp(0)))
+
+			//changed while no agent is running
+			err = db.DB(database).C("user").UpdateId(userID, bson.M{"$set": bson.M{"username": "witch"}})
+			Expect(err).ToNot(HaveOccurred())
+
+			time.Sleep(sleepDuration)
+			cancel, result = run(config)
+
+			time.Sleep(sleepDuration)
+			cancel()
+			Expect(<-result).ToNot(HaveOccurred())
+
+			comment := struct{ Meta map[string]interface{} }{}
+			err = db.Copy().DB(database).C("resumeComment").Find(bson.M{"text": "resume"}).One(&comment)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(comment.Meta).To(Equal(map[string]interface{}{"username": "witch"}))
+		})
+
+		It("will stop if the oplog does not reach back to the checkpoint", func() {
+			db, err := mgo.Dial("localhost:30000,localhost:30001,localhost:30002")
+			Expect(err).ToNot(HaveOccurred())
+
+			config := checkpointConfig("gap", "gapComment")
+			store, err := NewCheckpointStore(config.Checkpoint, db)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(store.Save(bson.MongoTimestamp(1 << 32))).To(Succeed())
+
+			gaps := expvar.Get("redkeepOplogGaps").(*expvar.Int)
+			before := gaps.Value()
+
+			cancel, result := run(config)
+			defer cancel()
+
+			select {
+			case err := <-result:
+				Expect(err).To(BeAssignableToTypeOf(OplogGapError{}))
+				Expect(err.(OplogGapError).Resume).To(Equal(bson.MongoTimestamp(1 << 32)))
+			case <-time.After(time.Second):
+				Fail("Run did not return the oplog gap")
+			}
+
+			Expect(gaps.Value()).To(Equal(before + 1))
+		})
+
+		It("will backfill and keep running on a gap if configured", func() {
+			db, err := mgo.Dial("localhost:30000,localhost:30001,localhost:30002")
+			Expect(err).ToNot(HaveOccurred())
+
+			userID := bson.NewObjectId()
+			err = db.DB(database).C("user").Insert(bson.M{"_id": userID, "username": "pietro"})
+			Expect(err).ToNot(HaveOccurred())
+
+			err = db.DB(database).C("backfilledComment").Insert(bson.M{
+				"text": "missed",
+				"user": mgo.DBRef{Database: database, Id: userID, Collection: "user"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			config := checkpointConfig("backfillGap", "backfilledComment")
+			config.Agent.BackfillOnGap = true
+			store, err := NewCheckpointStore(config.Checkpoint, db)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(store.Save(bson.MongoTimestamp(1 << 32))).To(Succeed())
+
+			gaps := expvar.Get("redkeepOplogGaps").(*expvar.Int)
+			before := gaps.Value()
+
+			cancel, result := run(config)
+
+			select {
+			case err := <-result:
+				Fail(fmt.Sprintf("Run returned after the backfill: %v", err))
+			case <-time.After(10 * sleepDuration):
+			}
+
+			Expect(gaps.Value()).To(Equal(before + 1))
+
+			comment := struct{ Meta map[string]interface{} }{}
+			err = db.Copy().DB(database).C("backfilledComment").Find(bson.M{"text": "missed"}).One(&comment)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(comment.Meta).To(Equal(map[string]interface{}{"username": "pietro"}))
+
+			//tailing continues at the checkpoint, the replayed
+			//oplog might not be analyzed within the grace period
+			cancel()
+			err = <-result
+			Expect(err == nil || err == ErrGracePeriodExceeded).To(BeTrue())
+		})
+	})
+
+	Context("Shutdown testcases", func() {
+		It("will stop after the grace period even if entries are queued", func() {
+			db, err := mgo.Dial("localhost:30000,localhost:30001,localhost:30002")
+			Expect(err).ToNot(HaveOccurred())
+
+			userRef := mgo.DBRef{Database: database, Id: bson.NewObjectId(), Collection: "user"}
+			bulk := db.DB(database).C("queuedComment").Bulk()
+			for i := 0; i < 2000; i++ {
+				bulk.Insert(bson.M{"text": fmt.Sprintf("queued %d", i), "user": userRef})
+			}
+
+			_, err = bulk.Run()
+			Expect(err).ToNot(HaveOccurred())
+
+			output, err := ioutil.TempFile("", "redkeep")
+			Expect(err).ToNot(HaveOccurred())
+			output.Close()
+
+			config := Configuration{
+				Mongo: Mongo{ConnectionURI: "localhost:30000,localhost:30001,localhost:30002"},
+				Agent: AgentSettings{
+					Workers:             1,
+					ShutdownGracePeriod: "1ns",
+					ForceRescan:         true,
+					DryRun:              true,
+					DryRunOutput:        output.Name(),
+				},
+				Watches: []Watch{{
+					TrackCollection:       database + ".user",
+					TrackFields:           []string{"username"},
+					TargetCollection:      database + ".queuedComment",
+					TargetNormalizedField: "meta",
+					TriggerReference:      "user",
+				}},
+			}
+
+			agent, err := NewTailAgent(config)
+			Expect(err).ToNot(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			result := make(chan error)
+			go func() {
+				result <- agent.Run(ctx)
+			}()
+
+			time.Sleep(sleepDuration)
+			cancel()
+
+			select {
+			case err := <-result:
+				Expect(err).To(Equal(ErrGracePeriodExceeded))
+			case <-time.After(time.Second):
+				Fail("Run did not return after the grace period")
+			}
+
+			//the entry that was analyzed when the grace period
+			//ended still uses the session, Close waits for it
+			agent.Close()
+		})
+	})
+
+	Context("test OplogGapError", func() {
+		It("will report both timestamps", func() {
+			gap := OplogGapError{
+				Resume: bson.MongoTimestamp(1453743296 << 32),
+				Oldest: bson.MongoTimestamp(1453829696<<32 | 1),
+			}
+
+			Expect(gap.Error()).To(Equal("Oplog gap detected, resuming after 2016-01-25 17:34:56 +0000 UTC but the oldest oplog entry is from 2016-01-26 17:34:56 +0000 UTC"))
+		})
 	})
 
 	Context("test GetValue", func() {
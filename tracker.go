@@ -1,8 +1,10 @@
 package redkeep
 
 import (
+	"io"
 	"log"
 	"strings"
+	"time"
 
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
@@ -19,109 +21,382 @@ type Tracker interface {
 }
 
 //RemoveTracker can handle removes
+//an error means the change has not been applied completely
 type RemoveTracker interface {
 	HandleRemove(
 		w Watch,
 		command map[string]interface{},
 		selector map[string]interface{},
-	)
+	) error
 }
 
 //UpdateTracker can handle updates
+//an error means the change has not been applied completely
 type UpdateTracker interface {
 	HandleUpdate(
 		w Watch,
 		command map[string]interface{},
 		selector map[string]interface{},
-	)
+	) error
 }
 
 //InsertTracker can handle inserts
+//an error means the change has not been applied completely
 type InsertTracker interface {
 	HandleInsert(
 		w Watch,
 		command map[string]interface{},
 		originRef mgo.DBRef,
-	)
+	) error
 }
 
+//changeTracker reads with session and
+//executes all generated queries with writer
 type changeTracker struct {
 	session *mgo.Session
+	writer  queryWriter
+	parents *parentLocks
 }
 
-func (c changeTracker) HandleUpdate(w Watch, command map[string]interface{}, selector map[string]interface{}) {
-	session := c.session.Copy()
-	defer session.Close()
-	p := strings.Index(w.TargetCollection, ".")
-	targetDB := w.TargetCollection[:p]
-	targetCollection := w.TargetCollection[p+1:]
-	collection := session.DB(targetDB).C(targetCollection)
-
+func (c changeTracker) HandleUpdate(w Watch, command map[string]interface{}, selector map[string]interface{}) error {
 	refID, ok := selector["_id"]
 	if !ok {
 		log.Println("No id found.")
-		return
+		return nil
+	}
+
+	reference, ok, err := targetReference(c.session, w, refID)
+	if err != nil || !ok {
+		return err
+	}
+
+	var build func(Watch) bson.M
+	switch {
+	case w.BehaviourSettings.UpdateMode == UpdateModeRefetch:
+		if !TouchesTrackedFields(w, command) {
+			return nil
+		}
+
+		source, ok, err := loadSource(c.session, w, refID)
+		if err != nil || !ok {
+			return err
+		}
+
+		build = func(t Watch) bson.M { return BuildRefetchQuery(t, source) }
+	case RequiresResync(w, command) || touchesTransforms(w, command):
+		source, ok, err := loadSource(c.session, w, refID)
+		if err != nil || !ok {
+			return err
+		}
+
+		build = func(t Watch) bson.M { return BuildReplaceQuery(t, source) }
+	default:
+		build = func(t Watch) bson.M { return BuildUpdateQuery(t, command) }
 	}
 
-	updateQuery := BuildUpdateQuery(w, command)
-	if updateQuery == nil {
-		return
+	return c.updateTargets(w, reference, build)
+}
+
+func (c changeTracker) HandleRemove(w Watch, command map[string]interface{}, selector map[string]interface{}) error {
+	policy := w.BehaviourSettings.DeletePolicy()
+	if policy == OnDeleteKeep {
+		return nil
 	}
 
-	selectQuery := bson.M{w.TriggerReference + ".$id": refID}
-	_, err := collection.UpdateAll(selectQuery, updateQuery)
+	refID, ok := selector["_id"]
+	if !ok {
+		log.Println("No id found.")
+		return nil
+	}
+
+	reference, ok, err := targetReference(c.session, w, refID)
 	if err != nil {
-		log.Println("Query could not be executed successfully.")
+		return err
 	}
+
+	if !ok {
+		log.Println("Targets of removed document can not be selected.")
+		return nil
+	}
+
+	switch policy {
+	case OnDeleteRemove:
+		err = c.removeTargets(w, reference)
+	case OnDeleteUnset:
+		err = c.updateTargets(w, reference, func(t Watch) bson.M {
+			return bson.M{"$unset": bson.M{t.TargetNormalizedField: ""}}
+		})
+	case OnDeleteMarkOrphaned:
+		err = c.updateTargets(w, reference, func(t Watch) bson.M {
+			return bson.M{"$set": bson.M{t.TargetNormalizedField: tombstone(w)}}
+		})
+	case OnDeleteNullify:
+		err = c.updateTargets(w, reference, func(t Watch) bson.M {
+			return bson.M{"$set": bson.M{t.TriggerReference: nil}}
+		})
+	}
+
+	return err
 }
 
-func (c changeTracker) HandleRemove(w Watch, command map[string]interface{}, selector map[string]interface{}) {
-	log.Println("-- Remove is not yet implemented")
+//removeTargets removes all targets that contain reference, embedded
+//references only remove their subdocument and arrays of references
+//only the reference and its entry of the normalized field
+func (c changeTracker) removeTargets(w Watch, reference interface{}) error {
+	if w.ReferenceArray {
+		element := reference
+		if referenceType(w) == ReferenceDBRef {
+			element = bson.M{"$id": reference}
+		}
+
+		return c.writer.UpdateAll(w.TargetCollection, targetSelector(w, reference), bson.M{
+			"$pull":  bson.M{w.TriggerReference: element},
+			"$unset": bson.M{normalizedWatch(w, reference, -1).TargetNormalizedField: ""},
+		})
+	}
+
+	array, field, embedded := embeddedPath(w.TriggerReference)
+	if !embedded {
+		return c.writer.RemoveAll(w.TargetCollection, targetSelector(w, reference))
+	}
+
+	element := w
+	element.TriggerReference = field
+	return c.writer.UpdateAll(
+		w.TargetCollection,
+		targetSelector(w, reference),
+		bson.M{"$pull": bson.M{array: targetSelector(element, reference)}},
+	)
 }
 
-func (c changeTracker) HandleInsert(w Watch, command map[string]interface{}, originRef mgo.DBRef) {
-	reference := GetValue(w.TriggerReference, command)
-	if reference == nil {
-		reference = GetValue("$set."+w.TriggerReference, command)
+//updateTargets updates all targets that contain reference with the query
+//build returns for the watch of that reference (see normalizedWatch)
+func (c changeTracker) updateTargets(w Watch, reference interface{}, build func(Watch) bson.M) error {
+	if _, _, embedded := embeddedPath(w.TriggerReference); embedded {
+		return c.updateEmbeddedTargets(w, reference, build)
 	}
 
-	if reference == nil {
-		return
+	query := build(normalizedWatch(w, reference, -1))
+	if query == nil {
+		return nil
 	}
 
-	ref, ok := getReference(reference, originRef.Database)
-	if !ok {
-		return
+	return c.writer.UpdateAll(w.TargetCollection, targetSelector(w, reference), query)
+}
+
+//updateEmbeddedTargets works like updateTargets for references inside of
+//arrays of subdocuments. The position of the matching subdocuments is read
+//from every target, the update only applies if they did not move meanwhile.
+func (c changeTracker) updateEmbeddedTargets(w Watch, reference interface{}, build func(Watch) bson.M) error {
+	session := c.session.Copy()
+	defer session.Close()
+
+	var target map[string]interface{}
+	iter := getCollection(session, w.TargetCollection).Find(targetSelector(w, reference)).Iter()
+	for iter.Next(&target) {
+		query := bson.M{}
+		selector := bson.M{"_id": target["_id"]}
+		for _, r := range documentReferences(w, target) {
+			if !matchesReference(w, r.value, reference) {
+				continue
+			}
+
+			element := normalizedWatch(w, reference, r.index)
+			for operator, fields := range build(element) {
+				fields, _ := fields.(bson.M)
+				for key, value := range fields {
+					addToQuery(query, operator, key, value)
+				}
+			}
+
+			for key, value := range targetSelector(element, reference) {
+				selector[key] = value
+			}
+		}
+
+		if len(query) > 0 {
+			if err := c.writer.Update(w.TargetCollection, selector, query); err != nil && err != mgo.ErrNotFound {
+				iter.Close()
+				return err
+			}
+		}
+
+		target = nil
 	}
 
+	return iter.Close()
+}
+
+//tombstone generates the value that replaces the
+//normalized field of orphaned targets
+func tombstone(w Watch) bson.M {
+	result := bson.M{"deleted": true}
+	if w.BehaviourSettings.Tombstone != nil {
+		result = bson.M{}
+		for k, v := range w.BehaviourSettings.Tombstone {
+			result[k] = v
+		}
+	}
+
+	result["deletedAt"] = time.Now()
+
+	return result
+}
+
+func (c changeTracker) HandleInsert(w Watch, command map[string]interface{}, originRef mgo.DBRef) error {
 	session := c.session.Copy()
 	defer session.Close()
 
-	user := map[string]interface{}{}
+	namespace := originRef.Database + "." + originRef.Collection
 
-	collection := session.DB(ref.Database).C(ref.Collection)
-	err := collection.FindId(ref.Id).One(&user)
+	//positions inside of arrays of subdocuments are only
+	//known for sure in the current version of the target
+	if _, _, embedded := embeddedPath(w.TriggerReference); embedded && !isReplacement(command) {
+		if !touchesEmbeddedArray(w, command) {
+			return nil
+		}
 
-	if err != nil {
-		log.Println("User not found for update")
-		return
+		command = map[string]interface{}{}
+		err := getCollection(session, namespace).FindId(originRef.Id).One(&command)
+		if err == mgo.ErrNotFound {
+			log.Println("Target not found for update")
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
 	}
 
-	query := BuildInsertQuery(w, user)
-	if query == nil {
+	references := insertedReferences(w, command)
+	query := bson.M{}
+
+	//entries of references that have been removed from the array
+	//can only be found if the command contains the complete array
+	if w.ReferenceArray && (isReplacement(command) || GetValue("$set."+w.TriggerReference, command) != nil) {
+		stale, err := c.staleTargetEntries(session, w, namespace, originRef.Id, command, references)
+		if err != nil {
+			return err
+		}
+
+		for _, path := range stale {
+			addToQuery(query, "$unset", path, "")
+		}
+	}
+
+	if len(references) == 0 && len(query) == 0 {
+		return nil
+	}
+
+	for _, reference := range references {
+		ref, ok := getSourceRef(w, reference.value, originRef.Database)
+		if !ok {
+			continue
+		}
+
+		ref, ok, err := followVia(w, ref, loadFunc(session))
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			continue
+		}
+
+		user := map[string]interface{}{}
+
+		collection := getCollection(session, ref.Namespace)
+		err = collection.Find(ref.selector()).One(&user)
+
+		if err == mgo.ErrNotFound {
+			log.Println("User not found for update")
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		fields, _ := BuildInsertQuery(normalizedWatch(w, ref.Value, reference.index), user)["$set"].(bson.M)
+		for key, value := range fields {
+			addToQuery(query, "$set", key, value)
+		}
+	}
+
+	if len(query) == 0 {
 		log.Println("Empty query, need an update")
-		return
+		return nil
+	}
+
+	err := c.writer.Update(namespace, bson.M{"_id": originRef.Id}, query)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+
+	return err
+}
+
+//staleTargetEntries returns the entries of references that are not part of the
+//array of references of the target anymore, references are the current ones
+func (c changeTracker) staleTargetEntries(
+	session *mgo.Session,
+	w Watch,
+	namespace string,
+	id interface{},
+	command map[string]interface{},
+	references []documentReference,
+) ([]string, error) {
+	target := command
+	if !isReplacement(command) {
+		target = map[string]interface{}{}
+		err := getCollection(session, namespace).FindId(id).Select(bson.M{w.TargetNormalizedField: 1}).One(&target)
+		if err == mgo.ErrNotFound {
+			return nil, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	db := namespace[:strings.Index(namespace, ".")]
+	return staleEntries(w, db, GetValue(w.TargetNormalizedField, target), references), nil
+}
+
+//loadSource loads the current version of
+//the tracked document with the given id
+func loadSource(s *mgo.Session, w Watch, id interface{}) (map[string]interface{}, bool, error) {
+	session := s.Copy()
+	defer session.Close()
+
+	source := map[string]interface{}{}
+	err := getCollection(session, w.TrackCollection).FindId(id).One(&source)
+	if err == mgo.ErrNotFound {
+		log.Println("Source not found for resync")
+		return nil, false, nil
 	}
 
-	collection = session.DB(originRef.Database).C(originRef.Collection)
-	err = collection.Update(bson.M{"_id": originRef.Id.(bson.ObjectId)}, query)
 	if err != nil {
-		log.Println("Query could not be executed successfully." + err.Error())
-		return
+		return nil, false, err
 	}
+
+	return source, true, nil
+}
+
+//getCollection returns the collection of a namespace
+//in the scheme database.collection
+func getCollection(session *mgo.Session, namespace string) *mgo.Collection {
+	p := strings.Index(namespace, ".")
+	return session.DB(namespace[:p]).C(namespace[p+1:])
 }
 
 //NewChangeTracker is the default tracker implementation of redkeep
 func NewChangeTracker(session *mgo.Session) Tracker {
-	return &changeTracker{session: session}
+	return &changeTracker{session: session, writer: mongoWriter{session: session}, parents: &parentLocks{}}
+}
+
+//NewDryRunTracker works like NewChangeTracker but never writes,
+//all queries are written to out as JSON lines (see DryRunQuery)
+func NewDryRunTracker(session *mgo.Session, out io.Writer) Tracker {
+	return &changeTracker{session: session, writer: newDryRunWriter(out), parents: &parentLocks{}}
 }
@@ -0,0 +1,151 @@
+package redkeep_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+
+	. "github.com/manyminds/redkeep"
+	"gopkg.in/mgo.v2/bson"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+var _ = Describe("Tracker tests", func() {
+	Context("dry run", func() {
+		var (
+			w       Watch
+			out     *bytes.Buffer
+			tracker Tracker
+		)
+
+		BeforeEach(func() {
+			w = Watch{
+				TrackCollection:       "live.user",
+				TrackFields:           []string{"username"},
+				TargetCollection:      "live.comment",
+				TargetNormalizedField: "meta",
+				TriggerReference:      "user",
+			}
+
+			out = &bytes.Buffer{}
+			tracker = NewDryRunTracker(nil, out)
+		})
+
+		It("will print updates instead of executing them", func() {
+			tracker.HandleUpdate(
+				w,
+				map[string]interface{}{"$set": map[string]interface{}{"username": "nino"}},
+				map[string]interface{}{"_id": "56a65494b204ccd1edc0b055"},
+			)
+
+			var actual DryRunQuery
+			Expect(json.Unmarshal(out.Bytes(), &actual)).To(Succeed())
+			Expect(actual).To(Equal(DryRunQuery{
+				Operation: "updateAll",
+				Namespace: "live.comment",
+				Selector:  bson.M{"user.$id": "56a65494b204ccd1edc0b055"},
+				Update:    bson.M{"$set": map[string]interface{}{"meta.username": "nino"}},
+			}))
+		})
+
+		It("will print removes instead of executing them", func() {
+			w.BehaviourSettings.CascadeDelete = true
+			tracker.HandleRemove(
+				w,
+				map[string]interface{}{"_id": "56a65494b204ccd1edc0b055"},
+				map[string]interface{}{"_id": "56a65494b204ccd1edc0b055"},
+			)
+
+			var actual DryRunQuery
+			Expect(json.Unmarshal(out.Bytes(), &actual)).To(Succeed())
+			Expect(actual).To(Equal(DryRunQuery{
+				Operation: "removeAll",
+				Namespace: "live.comment",
+				Selector:  bson.M{"user.$id": "56a65494b204ccd1edc0b055"},
+			}))
+		})
+
+		It("will only pull the removed reference from arrays of references", func() {
+			w.TriggerReference = "participants"
+			w.ReferenceArray = true
+			w.BehaviourSettings.OnDelete = OnDeleteRemove
+			tracker.HandleRemove(
+				w,
+				map[string]interface{}{"_id": "56a65494b204ccd1edc0b055"},
+				map[string]interface{}{"_id": "56a65494b204ccd1edc0b055"},
+			)
+
+			var actual DryRunQuery
+			Expect(json.Unmarshal(out.Bytes(), &actual)).To(Succeed())
+			Expect(actual).To(Equal(DryRunQuery{
+				Operation: "updateAll",
+				Namespace: "live.comment",
+				Selector:  bson.M{"participants.$id": "56a65494b204ccd1edc0b055"},
+				Update: bson.M{
+					"$pull":  map[string]interface{}{"participants": map[string]interface{}{"$id": "56a65494b204ccd1edc0b055"}},
+					"$unset": map[string]interface{}{"meta.56a65494b204ccd1edc0b055": ""},
+				},
+			}))
+		})
+
+		It("will return errors of queries that could not be executed", func() {
+			tracker = NewDryRunTracker(nil, failingWriter{})
+			err := tracker.HandleUpdate(
+				w,
+				map[string]interface{}{"$set": map[string]interface{}{"username": "nino"}},
+				map[string]interface{}{"_id": "56a65494b204ccd1edc0b055"},
+			)
+
+			Expect(err).To(MatchError("disk full"))
+		})
+
+		It("will update the entry of one reference in arrays of references", func() {
+			w.TriggerReference = "participants"
+			w.ReferenceArray = true
+			tracker.HandleUpdate(
+				w,
+				map[string]interface{}{"$set": map[string]interface{}{"username": "nino"}},
+				map[string]interface{}{"_id": "56a65494b204ccd1edc0b055"},
+			)
+
+			var actual DryRunQuery
+			Expect(json.Unmarshal(out.Bytes(), &actual)).To(Succeed())
+			Expect(actual).To(Equal(DryRunQuery{
+				Operation: "updateAll",
+				Namespace: "live.comment",
+				Selector:  bson.M{"participants.$id": "56a65494b204ccd1edc0b055"},
+				Update: bson.M{"$set": map[string]interface{}{
+					"meta.56a65494b204ccd1edc0b055.username": "nino",
+				}},
+			}))
+		})
+
+		It("will only nullify the removed reference in arrays of references", func() {
+			w.TriggerReference = "participants"
+			w.ReferenceArray = true
+			w.BehaviourSettings.OnDelete = OnDeleteNullify
+			tracker.HandleRemove(
+				w,
+				map[string]interface{}{"_id": "56a65494b204ccd1edc0b055"},
+				map[string]interface{}{"_id": "56a65494b204ccd1edc0b055"},
+			)
+
+			var actual DryRunQuery
+			Expect(json.Unmarshal(out.Bytes(), &actual)).To(Succeed())
+			Expect(actual).To(Equal(DryRunQuery{
+				Operation: "updateAll",
+				Namespace: "live.comment",
+				Selector:  bson.M{"participants.$id": "56a65494b204ccd1edc0b055"},
+				Update:    bson.M{"$set": map[string]interface{}{"participants.$": nil}},
+			}))
+		})
+	})
+})
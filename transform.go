@@ -0,0 +1,138 @@
+package redkeep
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+)
+
+//transformFuncs can be used in all transforms
+var transformFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"title": strings.Title,
+	"trim":  strings.TrimSpace,
+}
+
+//transformCache keeps every parsed transform, watches are
+//passed by value so the templates can not be stored inside
+var transformCache = struct {
+	sync.Mutex
+	templates map[string]*template.Template
+}{templates: map[string]*template.Template{}}
+
+//parseTransform returns the parsed template of a transform
+func parseTransform(text string) (*template.Template, error) {
+	transformCache.Lock()
+	defer transformCache.Unlock()
+
+	if t, ok := transformCache.templates[text]; ok {
+		return t, nil
+	}
+
+	t, err := template.New("transform").Funcs(transformFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	transformCache.templates[text] = t
+	return t, nil
+}
+
+//transformValues evaluates all transforms of w on the
+//source document, the result is keyed by the target name
+func transformValues(w Watch, document map[string]interface{}) map[string]interface{} {
+	result := map[string]interface{}{}
+	for name, text := range w.Transforms {
+		t, err := parseTransform(text)
+		if err != nil {
+			log.Println("Transform " + name + " is invalid: " + err.Error())
+			continue
+		}
+
+		var buffer bytes.Buffer
+		if err := t.Execute(&buffer, document); err != nil {
+			log.Println("Transform " + name + " failed: " + err.Error())
+			continue
+		}
+
+		//missing fields of maps are always rendered like this
+		result[name] = strings.Replace(buffer.String(), "<no value>", "", -1)
+	}
+
+	return result
+}
+
+//transformFields returns all fields of the tracked document the
+//transforms of w read, changes of them require a recomputation
+func transformFields(w Watch) []string {
+	var result []string
+	for _, text := range w.Transforms {
+		t, err := parseTransform(text)
+		if err != nil {
+			continue
+		}
+
+		result = append(result, nodeFields(t.Tree.Root)...)
+	}
+
+	return result
+}
+
+//nodeFields collects all fields like .name.firstName below node
+func nodeFields(node parse.Node) []string {
+	var result []string
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+
+		for _, child := range n.Nodes {
+			result = append(result, nodeFields(child)...)
+		}
+	case *parse.ActionNode:
+		result = nodeFields(n.Pipe)
+	case *parse.PipeNode:
+		if n == nil {
+			return nil
+		}
+
+		for _, cmd := range n.Cmds {
+			result = append(result, nodeFields(cmd)...)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			result = append(result, nodeFields(arg)...)
+		}
+	case *parse.IfNode:
+		result = branchFields(n.BranchNode)
+	case *parse.RangeNode:
+		result = branchFields(n.BranchNode)
+	case *parse.WithNode:
+		result = branchFields(n.BranchNode)
+	case *parse.FieldNode:
+		result = []string{strings.Join(n.Ident, ".")}
+	}
+
+	return result
+}
+
+func branchFields(n parse.BranchNode) []string {
+	result := nodeFields(n.Pipe)
+	result = append(result, nodeFields(n.List)...)
+	return append(result, nodeFields(n.ElseList)...)
+}
+
+//touchesTransforms returns true if command might
+//change a field that is read by a transform of w
+func touchesTransforms(w Watch, command map[string]interface{}) bool {
+	if len(w.Transforms) == 0 {
+		return false
+	}
+
+	return TouchesTrackedFields(Watch{TrackFields: transformFields(w)}, command)
+}
@@ -1,9 +1,12 @@
 package redkeep
 
-import "strings"
+import (
+	"strconv"
+	"strings"
+)
 
 //GetValue works like this:
-//from must be a selector like user.comment.author
+//from must be a selector like user.comment.author or answers.0.author
 //GetValue then looks recursively for that element
 //therefore all of the following return values are possible
 //map[string]interface{}
@@ -11,14 +14,55 @@ import "strings"
 //string
 //or basic mongodb types
 func GetValue(from string, ds interface{}) interface{} {
-	data, ok := ds.(map[string]interface{})
-	if !ok {
-		return nil
-	}
+	value, _ := lookupValue(from, ds)
+	return value
+}
 
+//lookupValue works like GetValue but additionally
+//reports whether the element exists at all
+//elements of arrays are selected by their index like answers.0.author
+func lookupValue(from string, ds interface{}) (interface{}, bool) {
+	key, rest := from, ""
 	if index := strings.Index(from, "."); index != -1 {
-		return GetValue(from[index+1:], data[from[:index]])
+		key, rest = from[:index], from[index+1:]
+	}
+
+	var (
+		value interface{}
+		ok    bool
+	)
+
+	switch data := ds.(type) {
+	case map[string]interface{}:
+		value, ok = data[key]
+	case []interface{}:
+		index, err := strconv.Atoi(key)
+		if err == nil && index >= 0 && index < len(data) {
+			value, ok = data[index], true
+		}
+	}
+
+	if !ok || rest == "" {
+		return value, ok
+	}
+
+	return lookupValue(rest, value)
+}
+
+//setValue stores value at the selector from inside of ds,
+//missing subdocuments will be created
+func setValue(from string, ds map[string]interface{}, value interface{}) {
+	index := strings.Index(from, ".")
+	if index == -1 {
+		ds[from] = value
+		return
+	}
+
+	sub, ok := ds[from[:index]].(map[string]interface{})
+	if !ok {
+		sub = map[string]interface{}{}
+		ds[from[:index]] = sub
 	}
 
-	return data[from]
+	setValue(from[index+1:], sub, value)
 }
@@ -0,0 +1,34 @@
+package redkeep_test
+
+import (
+	. "github.com/manyminds/redkeep"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Utils tests", func() {
+	Context("GetValue", func() {
+		document := map[string]interface{}{
+			"user": map[string]interface{}{"name": "nino"},
+			"answers": []interface{}{
+				map[string]interface{}{"author": "first"},
+				map[string]interface{}{"author": "second"},
+			},
+		}
+
+		It("will find nested values", func() {
+			Expect(GetValue("user.name", document)).To(Equal("nino"))
+		})
+
+		It("will find values inside of arrays by index", func() {
+			Expect(GetValue("answers.1.author", document)).To(Equal("second"))
+		})
+
+		It("will return nil for missing values", func() {
+			Expect(GetValue("user.age", document)).To(BeNil())
+			Expect(GetValue("answers.2.author", document)).To(BeNil())
+			Expect(GetValue("answers.first.author", document)).To(BeNil())
+		})
+	})
+})
@@ -0,0 +1,212 @@
+package redkeep
+
+import (
+	"reflect"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//all kinds of drift Verify can report
+const (
+	//DriftMismatch means at least one normalized field differs from its source
+	DriftMismatch = "mismatch"
+	//DriftMissingReference means the target contains no valid reference
+	DriftMissingReference = "missingReference"
+	//DriftDanglingReference means the referenced document does not exist
+	DriftDanglingReference = "danglingReference"
+)
+
+//Drift describes one target document that is out of sync
+type Drift struct {
+	Kind       string       `json:"kind"`
+	Collection string       `json:"collection"`
+	ID         interface{}  `json:"id"`
+	SourceID   interface{}  `json:"sourceId,omitempty"`
+	Fields     []FieldDrift `json:"fields,omitempty"`
+}
+
+//FieldDrift is one normalized field that differs from its source.
+//Field is the tracked field, Target the path of its copy.
+//Missing is true if the field does not exist in the source,
+//entries of references that have been removed from an array
+//of references are missing and have no Field.
+type FieldDrift struct {
+	Field    string      `json:"field"`
+	Target   string      `json:"target"`
+	Expected interface{} `json:"expected"`
+	Actual   interface{} `json:"actual"`
+	Missing  bool        `json:"missing,omitempty"`
+}
+
+//VerifyReport summarizes the result of Verify
+type VerifyReport struct {
+	Checked            int `json:"checked"`
+	Mismatches         int `json:"mismatches"`
+	MissingReferences  int `json:"missingReferences"`
+	DanglingReferences int `json:"danglingReferences"`
+}
+
+//Verify compares the normalized fields of all documents in the target
+//collection of w with their referenced documents. Every target that is
+//out of sync is passed to report.
+func Verify(session *mgo.Session, w Watch, report func(Drift)) (VerifyReport, error) {
+	return verifyWatch(session, w, defaultBatchSize, func(drifts []Drift) error {
+		for _, d := range drifts {
+			report(d)
+		}
+
+		return nil
+	})
+}
+
+//verifyWatch verifies all targets of w in batches of batchSize,
+//the drifts of every batch are passed to handle
+func verifyWatch(session *mgo.Session, w Watch, batchSize int, handle func([]Drift) error) (VerifyReport, error) {
+	session = session.Copy()
+	defer session.Close()
+
+	if isSummary(w) {
+		return verifyComputed(session, w, batchSize, handle, computeSummary(session, w))
+	}
+
+	if isAggregate(w) {
+		return verifyComputed(session, w, batchSize, handle, computeAggregate(session, w))
+	}
+
+	targetDB := w.TargetCollection[:strings.Index(w.TargetCollection, ".")]
+	collection := getCollection(session, w.TargetCollection)
+
+	var result VerifyReport
+	err := scanTargets(collection, bson.M{}, nil, batchSize, func(batch []map[string]interface{}) error {
+		sources := newSourceCache(session)
+		var drifts []Drift
+		for _, target := range batch {
+			drift, err := verifyTarget(sources, w, targetDB, target)
+			if err != nil {
+				return err
+			}
+
+			result.Checked++
+			if drift == nil {
+				continue
+			}
+
+			switch drift.Kind {
+			case DriftMismatch:
+				result.Mismatches++
+			case DriftMissingReference:
+				result.MissingReferences++
+			case DriftDanglingReference:
+				result.DanglingReferences++
+			}
+
+			drifts = append(drifts, *drift)
+		}
+
+		return handle(drifts)
+	})
+
+	return result, err
+}
+
+//verifyTarget returns the drift of one target, nil if it is in sync.
+//For arrays of references all references are checked, a missing
+//reference wins over a dangling one, which wins over mismatches.
+func verifyTarget(sources *sourceCache, w Watch, targetDB string, target map[string]interface{}) (*Drift, error) {
+	drift := &Drift{Collection: w.TargetCollection, ID: target["_id"]}
+
+	references := documentReferences(w, target)
+	if len(references) == 0 {
+		drift.Kind = DriftMissingReference
+		return drift, nil
+	}
+
+	var fields []FieldDrift
+	for _, reference := range references {
+		ref, ok := getSourceRef(w, reference.value, targetDB)
+		if !ok {
+			drift.Kind = DriftMissingReference
+			return drift, nil
+		}
+
+		//a chain that breaks at one of its hops dangles as well
+		tracked, found, err := followVia(w, ref, sources.load)
+		if err != nil {
+			return nil, err
+		}
+
+		var source map[string]interface{}
+		if found {
+			source, err = sources.load(tracked)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if source == nil {
+			if drift.Kind == "" {
+				drift.Kind = DriftDanglingReference
+				drift.SourceID = ref.Value
+			}
+
+			continue
+		}
+
+		fields = append(fields, compareNormalized(normalizedWatch(w, ref.Value, reference.index), source, target)...)
+		if len(references) == 1 {
+			drift.SourceID = ref.Value
+		}
+	}
+
+	if drift.Kind != "" {
+		return drift, nil
+	}
+
+	for _, path := range staleEntries(w, targetDB, GetValue(w.TargetNormalizedField, target), references) {
+		actual, _ := lookupValue(path, target)
+		fields = append(fields, FieldDrift{Target: path, Actual: actual, Missing: true})
+	}
+
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	drift.Kind = DriftMismatch
+	drift.Fields = fields
+	return drift, nil
+}
+
+//compareNormalized returns all tracked fields and transforms
+//of source whose copy in target differs
+func compareNormalized(w Watch, source, target map[string]interface{}) []FieldDrift {
+	var result []FieldDrift
+	for _, field := range documentFields(w, source) {
+		path := targetField(w, field)
+		expected, expectedOk := lookupValue(field, source)
+		expected = withoutExcluded(w, field, expected)
+		actual, actualOk := lookupValue(path, target)
+
+		if expectedOk == actualOk && reflect.DeepEqual(expected, actual) {
+			continue
+		}
+
+		result = append(result, FieldDrift{
+			Field:    field,
+			Target:   path,
+			Expected: expected,
+			Actual:   actual,
+			Missing:  !expectedOk,
+		})
+	}
+
+	for name, expected := range transformValues(w, source) {
+		path := w.TargetNormalizedField + "." + name
+		if actual, ok := lookupValue(path, target); !ok || actual != expected {
+			result = append(result, FieldDrift{Field: name, Target: path, Expected: expected, Actual: actual})
+		}
+	}
+
+	return result
+}
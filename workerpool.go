@@ -0,0 +1,123 @@
+package redkeep
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWorkers   = 8
+	defaultQueueSize = 100
+)
+
+//oplogTask is one oplog entry that waits to be analyzed
+type oplogTask struct {
+	dataset map[string]interface{}
+	entry   *pendingEntry
+}
+
+//workerPool analyzes oplog entries in parallel. Entries are sharded
+//by the document they belong to, every worker handles its queue in
+//order, so changes of the same document are never reordered.
+type workerPool struct {
+	queues  []chan oplogTask
+	aborted chan struct{}
+	wg      sync.WaitGroup
+}
+
+//newWorkerPool starts the workers, handle is called with a channel
+//that is closed once the pool has been aborted (see drain)
+func newWorkerPool(workers, queueSize int, handle func(task oplogTask, aborted <-chan struct{})) *workerPool {
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+
+	p := &workerPool{
+		queues:  make([]chan oplogTask, workers),
+		aborted: make(chan struct{}),
+	}
+	for i := range p.queues {
+		queue := make(chan oplogTask, queueSize)
+		p.queues[i] = queue
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for task := range queue {
+				select {
+				case <-p.aborted:
+					//skipped tasks are never finished, the
+					//checkpoint will not advance beyond them
+					continue
+				default:
+				}
+
+				handle(task, p.aborted)
+			}
+		}()
+	}
+
+	return p
+}
+
+//dispatch queues the task, it blocks as long as the responsible
+//worker is saturated. It returns false if ctx is done before.
+func (p *workerPool) dispatch(ctx context.Context, task oplogTask) bool {
+	select {
+	case p.queues[shardIndex(task.dataset, len(p.queues))] <- task:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+//drain waits up to gracePeriod until all queued tasks are handled
+//afterwards remaining tasks are skipped and false is returned.
+//Tasks that are still being handled are not awaited (see wait),
+//they are never finished, so the checkpoint stays behind them.
+func (p *workerPool) drain(gracePeriod time.Duration) bool {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(gracePeriod):
+		close(p.aborted)
+		return false
+	}
+}
+
+//wait blocks until all workers returned, drain has to be called before
+func (p *workerPool) wait() {
+	p.wg.Wait()
+}
+
+//shardIndex picks the worker by namespace and id of the changed
+//document, updates carry the id in o2, everything else in o
+func shardIndex(dataset map[string]interface{}, shards int) int {
+	var id interface{}
+	if selector, ok := dataset["o2"].(map[string]interface{}); ok {
+		id = selector["_id"]
+	} else if command, ok := dataset["o"].(map[string]interface{}); ok {
+		id = command["_id"]
+	}
+
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%v/%v", dataset["ns"], id)
+
+	return int(h.Sum32() % uint32(shards))
+}
@@ -0,0 +1,95 @@
+package redkeep
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//queryWriter executes the queries of a tracker,
+//namespace is in the scheme database.collection
+type queryWriter interface {
+	Update(namespace string, selector, update bson.M) error
+	UpdateAll(namespace string, selector, update bson.M) error
+	Upsert(namespace string, selector, update bson.M) error
+	RemoveAll(namespace string, selector bson.M) error
+}
+
+type mongoWriter struct {
+	session *mgo.Session
+}
+
+func (m mongoWriter) Update(namespace string, selector, update bson.M) error {
+	session := m.session.Copy()
+	defer session.Close()
+
+	return getCollection(session, namespace).Update(selector, update)
+}
+
+func (m mongoWriter) UpdateAll(namespace string, selector, update bson.M) error {
+	session := m.session.Copy()
+	defer session.Close()
+
+	_, err := getCollection(session, namespace).UpdateAll(selector, update)
+	return err
+}
+
+func (m mongoWriter) Upsert(namespace string, selector, update bson.M) error {
+	session := m.session.Copy()
+	defer session.Close()
+
+	_, err := getCollection(session, namespace).Upsert(selector, update)
+	return err
+}
+
+func (m mongoWriter) RemoveAll(namespace string, selector bson.M) error {
+	session := m.session.Copy()
+	defer session.Close()
+
+	_, err := getCollection(session, namespace).RemoveAll(selector)
+	return err
+}
+
+//dryRunWriter writes every query as JSON line instead of executing it
+type dryRunWriter struct {
+	sync.Mutex
+	encoder *json.Encoder
+}
+
+//DryRunQuery is one query the dry run would have executed
+type DryRunQuery struct {
+	Operation string `json:"operation"`
+	Namespace string `json:"namespace"`
+	Selector  bson.M `json:"selector"`
+	Update    bson.M `json:"update,omitempty"`
+}
+
+func (d *dryRunWriter) write(query DryRunQuery) error {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.encoder.Encode(query)
+}
+
+func (d *dryRunWriter) Update(namespace string, selector, update bson.M) error {
+	return d.write(DryRunQuery{Operation: "update", Namespace: namespace, Selector: selector, Update: update})
+}
+
+func (d *dryRunWriter) UpdateAll(namespace string, selector, update bson.M) error {
+	return d.write(DryRunQuery{Operation: "updateAll", Namespace: namespace, Selector: selector, Update: update})
+}
+
+func (d *dryRunWriter) Upsert(namespace string, selector, update bson.M) error {
+	return d.write(DryRunQuery{Operation: "upsert", Namespace: namespace, Selector: selector, Update: update})
+}
+
+func (d *dryRunWriter) RemoveAll(namespace string, selector bson.M) error {
+	return d.write(DryRunQuery{Operation: "removeAll", Namespace: namespace, Selector: selector})
+}
+
+func newDryRunWriter(out io.Writer) *dryRunWriter {
+	return &dryRunWriter{encoder: json.NewEncoder(out)}
+}